@@ -0,0 +1,60 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// FloatingIPSpec maps an external IP to a VMI attached to a tenant network
+type FloatingIPSpec struct {
+	// ExternalIP is the IP reachable from outside the cluster
+	ExternalIP string `json:"externalIP"`
+	// Network is the name of the tenant network
+	Network string `json:"network"`
+	// VMI is the name of the VirtualMachineInstance at the FloatingIP
+	// namespace
+	VMI string `json:"vmi"`
+}
+
+// FloatingIPStatus shows where the FloatingIP is implemented
+type FloatingIPStatus struct {
+	// LogicalIP is the VMI address at the tenant network
+	// +optional
+	LogicalIP string `json:"logicalIP,omitempty"`
+	// Node is the node whose gateway router implements the FloatingIP
+	// +optional
+	Node string `json:"node,omitempty"`
+	// Error is the reason the FloatingIP cannot be implemented
+	// +optional
+	Error string `json:"error,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=fip
+// +kubebuilder:printcolumn:name="External IP",type=string,JSONPath=`.spec.externalIP`
+// +kubebuilder:printcolumn:name="VMI",type=string,JSONPath=`.spec.vmi`
+// +kubebuilder:printcolumn:name="Logical IP",type=string,JSONPath=`.status.logicalIP`
+// +kubebuilder:printcolumn:name="Node",type=string,JSONPath=`.status.node`
+
+// FloatingIP exposes a VMI on a tenant network with an OVN dnat_and_snat at
+// the gateway router the VMI traffic is rerouted to
+type FloatingIP struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   FloatingIPSpec   `json:"spec,omitempty"`
+	Status FloatingIPStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// FloatingIPList contains a list of FloatingIP
+type FloatingIPList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []FloatingIP `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&FloatingIP{}, &FloatingIPList{})
+}
@@ -0,0 +1,113 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Protocol is the L4 protocol of a TenantLoadBalancer port
+// +kubebuilder:validation:Enum=TCP;UDP;SCTP
+type Protocol string
+
+const (
+	ProtocolTCP  Protocol = "TCP"
+	ProtocolUDP  Protocol = "UDP"
+	ProtocolSCTP Protocol = "SCTP"
+)
+
+// TenantLoadBalancerPort maps a VIP port to the port of the backends
+type TenantLoadBalancerPort struct {
+	// Name of the port
+	// +optional
+	Name string `json:"name,omitempty"`
+	// Protocol of the port, TCP if not set
+	// +kubebuilder:default=TCP
+	// +optional
+	Protocol Protocol `json:"protocol,omitempty"`
+	// Port is the port exposed at the VIP
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port"`
+	// TargetPort is the port at the backends, same as Port if not set
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	TargetPort int32 `json:"targetPort,omitempty"`
+}
+
+// TenantLoadBalancerHealthCheck configures the OVN service monitor that
+// removes the unhealthy backends from the load balancer
+type TenantLoadBalancerHealthCheck struct {
+	// SourceIP is the address used by OVN to probe the backends, it has to
+	// be a free address of the tenant subnet so it should be part of the
+	// network exclude-ips
+	SourceIP string `json:"sourceIP"`
+	// Interval in seconds between probes
+	// +optional
+	Interval int32 `json:"interval,omitempty"`
+	// Timeout in seconds to wait for a probe response
+	// +optional
+	Timeout int32 `json:"timeout,omitempty"`
+	// SuccessCount is the number of successful probes to consider the
+	// backend healthy
+	// +optional
+	SuccessCount int32 `json:"successCount,omitempty"`
+	// FailureCount is the number of failed probes to consider the backend
+	// unhealthy
+	// +optional
+	FailureCount int32 `json:"failureCount,omitempty"`
+}
+
+// TenantLoadBalancerSpec balances the traffic sent to a VIP between the
+// VMIs attached to a tenant network
+type TenantLoadBalancerSpec struct {
+	// Network is the name of the tenant network
+	Network string `json:"network"`
+	// VIP is the load balancer virtual IP
+	VIP string `json:"vip"`
+	// Selector matches the labels of the backend VMIs at the
+	// TenantLoadBalancer namespace
+	Selector metav1.LabelSelector `json:"selector"`
+	// Ports exposed at the VIP
+	// +kubebuilder:validation:MinItems=1
+	Ports []TenantLoadBalancerPort `json:"ports"`
+	// HealthCheck enables probing the backends
+	// +optional
+	HealthCheck *TenantLoadBalancerHealthCheck `json:"healthCheck,omitempty"`
+}
+
+// TenantLoadBalancerStatus shows the backends of the TenantLoadBalancer
+type TenantLoadBalancerStatus struct {
+	// Backends are the tenant network addresses of the selected VMIs
+	// +optional
+	Backends []string `json:"backends,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:shortName=tlb
+// +kubebuilder:printcolumn:name="Network",type=string,JSONPath=`.spec.network`
+// +kubebuilder:printcolumn:name="VIP",type=string,JSONPath=`.spec.vip`
+// +kubebuilder:printcolumn:name="Backends",type=string,JSONPath=`.status.backends`
+
+// TenantLoadBalancer is implemented with OVN load balancers attached to the
+// tenant logical switch and the gateway routers
+type TenantLoadBalancer struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TenantLoadBalancerSpec   `json:"spec,omitempty"`
+	Status TenantLoadBalancerStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// TenantLoadBalancerList contains a list of TenantLoadBalancer
+type TenantLoadBalancerList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TenantLoadBalancer `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&TenantLoadBalancer{}, &TenantLoadBalancerList{})
+}
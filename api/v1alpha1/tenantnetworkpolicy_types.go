@@ -0,0 +1,117 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RuleAction is what is done with the traffic matching a rule
+// +kubebuilder:validation:Enum=Allow;Deny
+type RuleAction string
+
+const (
+	RuleActionAllow RuleAction = "Allow"
+	RuleActionDeny  RuleAction = "Deny"
+)
+
+// LogSeverity is the severity of the ACL log messages
+// +kubebuilder:validation:Enum=alert;warning;notice;info;debug
+type LogSeverity string
+
+// TenantNetworkPolicyPeer matches the other end of the traffic, by CIDR or
+// by the labels of the VMIs at the TenantNetworkPolicy namespace attached to
+// the tenant network
+type TenantNetworkPolicyPeer struct {
+	// CIDR matches an IP block
+	// +optional
+	CIDR string `json:"cidr,omitempty"`
+	// VMISelector matches the VMIs labels
+	// +optional
+	VMISelector *metav1.LabelSelector `json:"vmiSelector,omitempty"`
+}
+
+// TenantNetworkPolicyPort matches the traffic destination port, all the
+// protocol ports if Port is not set
+type TenantNetworkPolicyPort struct {
+	// Protocol of the port, TCP if not set
+	// +kubebuilder:default=TCP
+	// +optional
+	Protocol Protocol `json:"protocol,omitempty"`
+	// Port is the destination port
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	Port int32 `json:"port,omitempty"`
+	// EndPort makes the rule match the range from Port to EndPort
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	EndPort int32 `json:"endPort,omitempty"`
+}
+
+// TenantNetworkPolicyRule matches traffic by peer and port, it matches all
+// the peers or ports if they are empty
+type TenantNetworkPolicyRule struct {
+	// Action is Allow if not set
+	// +kubebuilder:default=Allow
+	// +optional
+	Action RuleAction `json:"action,omitempty"`
+	// Peers are the sources for ingress rules and the destinations for
+	// egress rules
+	// +optional
+	Peers []TenantNetworkPolicyPeer `json:"peers,omitempty"`
+	// Ports are the destination ports
+	// +optional
+	Ports []TenantNetworkPolicyPort `json:"ports,omitempty"`
+}
+
+// TenantNetworkPolicySpec filters the traffic of the VMIs attached to a
+// tenant network
+type TenantNetworkPolicySpec struct {
+	// Network is the name of the tenant network
+	Network string `json:"network"`
+	// VMISelector matches the labels of the VMIs at the TenantNetworkPolicy
+	// namespace the policy is applied to
+	VMISelector metav1.LabelSelector `json:"vmiSelector"`
+	// Ingress rules filter the traffic sent to the VMIs
+	// +optional
+	Ingress []TenantNetworkPolicyRule `json:"ingress,omitempty"`
+	// Egress rules filter the traffic sent by the VMIs
+	// +optional
+	Egress []TenantNetworkPolicyRule `json:"egress,omitempty"`
+	// DefaultDeny drops the VMIs traffic not allowed by the rules
+	// +optional
+	DefaultDeny bool `json:"defaultDeny,omitempty"`
+	// Log enables the ACL logging at ovn-controller
+	// +optional
+	Log bool `json:"log,omitempty"`
+	// Severity of the ACL log messages, info if not set
+	// +optional
+	Severity LogSeverity `json:"severity,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=tnp
+// +kubebuilder:printcolumn:name="Network",type=string,JSONPath=`.spec.network`
+// +kubebuilder:printcolumn:name="Default Deny",type=boolean,JSONPath=`.spec.defaultDeny`
+
+// TenantNetworkPolicy is implemented with OVN ACLs at a port group with the
+// selected VMIs ports and address sets with the peer VMIs addresses
+type TenantNetworkPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec TenantNetworkPolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// TenantNetworkPolicyList contains a list of TenantNetworkPolicy
+type TenantNetworkPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TenantNetworkPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&TenantNetworkPolicy{}, &TenantNetworkPolicyList{})
+}
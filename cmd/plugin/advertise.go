@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+
+	ovsclient "github.com/ovn-org/libovsdb/client"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/libovsdbops"
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+	ovnktypes "github.com/ovn-org/ovn-kubernetes/go-controller/pkg/types"
+
+	k8sclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// advertisedSubnetsAnnotation is set at the nodes with the JSON list of
+	// tenant subnets routed by the node gateway router. It's meant to be read
+	// by the BGP speaker configuration of the node, not part of the plugin,
+	// to advertise them with the node IP as nexthop. The plugin owns it and
+	// rewrites it from the NB tenant switches, it's removed from the nodes
+	// without gateway router and when there is nothing to advertise.
+	advertisedSubnetsAnnotation = "ovn-kubevirt/advertised-subnets"
+	// advertisedExternalIDKey is set at the tenant switch with "true" if
+	// masquerade is disabled, so its subnet is advertised
+	advertisedExternalIDKey = "ovn-kubevirt/advertised"
+)
+
+// unmasqueradeTenantSubnet removes the tenant subnet SNATs from the gateway
+// routers so the VMs are reachable from outside with their own IPs
+func unmasqueradeTenantSubnet(ctx *CmdContext, t *nbTxn) error {
+	ops, err := deleteNetworkSNATsOps(ctx.nbcli, t.ops, ctx.conf.Name, nil)
+	if err != nil {
+		return fmt.Errorf("failed removing tenant subnet masquerade: %v", err)
+	}
+	t.ops = ops
+	return nil
+}
+
+// advertisedSubnets returns the sorted subnets of the tenant switches with
+// masquerade disabled, the ones created before they had the advertised key
+// are advertised if their network has no dedicated router nor SNATs
+func advertisedSubnets(nbcli ovsclient.Client) ([]string, error) {
+	switches := []nbdb.LogicalSwitch{}
+	if err := nbcli.WhereCache(func(item *nbdb.LogicalSwitch) bool {
+		_, ok := item.ExternalIDs[networkExternalIDKey]
+		return ok && !isLayer2Switch(item)
+	}).List(context.Background(), &switches); err != nil {
+		return nil, fmt.Errorf("failed listing tenant switches: %v", err)
+	}
+	subnets := []string{}
+	for i := range switches {
+		ls := &switches[i]
+		advertised, ok := ls.ExternalIDs[advertisedExternalIDKey]
+		if ok && advertised != "true" {
+			continue
+		}
+		if !ok {
+			legacy, err := isLegacyAdvertised(nbcli, ls.ExternalIDs[networkExternalIDKey])
+			if err != nil {
+				return nil, err
+			}
+			if !legacy {
+				continue
+			}
+		}
+		if subnet := ls.OtherConfig["subnet"]; subnet != "" && !containsString(subnets, subnet) {
+			subnets = append(subnets, subnet)
+		}
+	}
+	sort.Strings(subnets)
+	return subnets, nil
+}
+
+func isLegacyAdvertised(nbcli ovsclient.Client, network string) (bool, error) {
+	dedicated, err := isDedicatedRouterNetwork(nbcli, network)
+	if err != nil || dedicated {
+		return false, err
+	}
+	nats, err := libovsdbops.FindNATsWithPredicate(nbcli, func(item *nbdb.NAT) bool {
+		return item.Type == nbdb.NATTypeSNAT && item.ExternalIDs[networkExternalIDKey] == network
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed looking for snats of network %s: %v", network, err)
+	}
+	return len(nats) == 0, nil
+}
+
+// syncAdvertisedSubnets sets the advertised subnets annotation of the nodes
+// with gateway router, the gateway routers of all the nodes have a route to
+// the tenant subnets so all of them can receive the traffic.
+func syncAdvertisedSubnets(ctx context.Context, k8scli k8sclient.Client, nbcli ovsclient.Client, nodes []corev1.Node) error {
+	subnets, err := advertisedSubnets(nbcli)
+	if err != nil {
+		return err
+	}
+	annotation, err := json.Marshal(subnets)
+	if err != nil {
+		return err
+	}
+	for i := range nodes {
+		node := &nodes[i]
+		gwRouter, err := findRouter(nbcli, ovnktypes.GWRouterPrefix+node.Name)
+		if err != nil {
+			return err
+		}
+		current, ok := node.Annotations[advertisedSubnetsAnnotation]
+		advertise := gwRouter != nil && len(subnets) > 0
+		if (advertise && current == string(annotation)) || (!advertise && !ok) {
+			continue
+		}
+		patch := k8sclient.MergeFrom(node.DeepCopy())
+		if advertise {
+			if node.Annotations == nil {
+				node.Annotations = map[string]string{}
+			}
+			node.Annotations[advertisedSubnetsAnnotation] = string(annotation)
+		} else {
+			delete(node.Annotations, advertisedSubnetsAnnotation)
+		}
+		if err := k8scli.Patch(ctx, node, patch); err != nil {
+			return fmt.Errorf("failed updating node %s advertised subnets: %v", node.Name, err)
+		}
+	}
+	return nil
+}
+
+func containsString(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-logr/stdr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	ovsclient "github.com/ovn-org/libovsdb/client"
+
+	ovnkubevirtv1alpha1 "github.com/qinqon/ovn-kubevirt/api/v1alpha1"
+
+	k8sclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const resyncPeriod = time.Minute
+
+// runController runs the controllers that reconcile the tenant networks
+// state that cannot be reconciled at the CNI ADD, like moving the egress ips
+// when the node is down or implementing the floating ips created after the
+// VMI.
+func runController(args []string) error {
+	flags := flag.NewFlagSet("controller", flag.ExitOnError)
+	kubeconfig := flags.String("kubeconfig", "", "path to the kubeconfig, in-cluster config is used if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctrl.SetLogger(stdr.New(log.Default()))
+
+	restCfg, err := restConfig(*kubeconfig)
+	if err != nil {
+		return fmt.Errorf("failed loading kubeconfig: %v", err)
+	}
+
+	mgr, err := ctrl.NewManager(restCfg, ctrl.Options{
+		Scheme:             pluginscheme,
+		MetricsBindAddress: "0",
+	})
+	if err != nil {
+		return fmt.Errorf("failed creating controller manager: %v", err)
+	}
+
+	// The ovnkube-db endpoint has to be read before the manager cache is
+	// started
+	k8scli, err := k8sclient.New(restCfg, k8sclient.Options{Scheme: pluginscheme})
+	if err != nil {
+		return err
+	}
+	nbcli, err := newNBClient(k8scli)
+	if err != nil {
+		return fmt.Errorf("failed connecting to nb database: %v", err)
+	}
+
+	if err := ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Node{}).
+		Complete(&nodeReconciler{k8scli: mgr.GetClient(), nbcli: nbcli}); err != nil {
+		return fmt.Errorf("failed creating node controller: %v", err)
+	}
+
+	fipReconciler := &floatingIPReconciler{k8scli: mgr.GetClient(), nbcli: nbcli}
+	if err := ctrl.NewControllerManagedBy(mgr).
+		For(&ovnkubevirtv1alpha1.FloatingIP{}).
+		Watches(&source.Kind{Type: &kubevirtv1.VirtualMachineInstance{}},
+			handler.EnqueueRequestsFromMapFunc(fipReconciler.vmiToFloatingIPs)).
+		Complete(fipReconciler); err != nil {
+		return fmt.Errorf("failed creating floating ip controller: %v", err)
+	}
+
+	tlbReconciler := &tenantLoadBalancerReconciler{k8scli: mgr.GetClient(), nbcli: nbcli}
+	if err := ctrl.NewControllerManagedBy(mgr).
+		For(&ovnkubevirtv1alpha1.TenantLoadBalancer{}).
+		Watches(&source.Kind{Type: &kubevirtv1.VirtualMachineInstance{}},
+			handler.EnqueueRequestsFromMapFunc(tlbReconciler.vmiToTenantLoadBalancers)).
+		Complete(tlbReconciler); err != nil {
+		return fmt.Errorf("failed creating tenant load balancer controller: %v", err)
+	}
+
+	tnpReconciler := &tenantNetworkPolicyReconciler{k8scli: mgr.GetClient(), nbcli: nbcli}
+	if err := ctrl.NewControllerManagedBy(mgr).
+		For(&ovnkubevirtv1alpha1.TenantNetworkPolicy{}).
+		Watches(&source.Kind{Type: &kubevirtv1.VirtualMachineInstance{}},
+			handler.EnqueueRequestsFromMapFunc(tnpReconciler.vmiToTenantNetworkPolicies)).
+		Complete(tnpReconciler); err != nil {
+		return fmt.Errorf("failed creating tenant network policy controller: %v", err)
+	}
+
+	return mgr.Start(ctrl.SetupSignalHandler())
+}
+
+func restConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig == "" {
+		return rest.InClusterConfig()
+	}
+	return clientcmd.BuildConfigFromFlags("", kubeconfig)
+}
+
+// nodeReconciler moves the tenant networks egress ips and the VMs n/s traffic
+// out of the nodes that are not ready, and keeps the nodes advertised subnets
+// up to date
+type nodeReconciler struct {
+	k8scli k8sclient.Client
+	nbcli  ovsclient.Client
+}
+
+func (r *nodeReconciler) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	nodeList := &corev1.NodeList{}
+	if err := r.k8scli.List(ctx, nodeList); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := reconcileEgressIPs(ctx, r.nbcli, nodeList.Items); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := reconcileGatewayFailover(ctx, r.k8scli, r.nbcli, nodeList.Items); err != nil {
+		return reconcile.Result{}, err
+	}
+	if err := syncAdvertisedSubnets(ctx, r.k8scli, r.nbcli, nodeList.Items); err != nil {
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{RequeueAfter: resyncPeriod}, nil
+}
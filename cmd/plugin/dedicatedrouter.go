@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/ovn-org/libovsdb/ovsdb"
+
+	ovsclient "github.com/ovn-org/libovsdb/client"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/libovsdbops"
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+	ovnktypes "github.com/ovn-org/ovn-kubernetes/go-controller/pkg/types"
+)
+
+const (
+	// transitSwitchName is the switch connecting the tenant dedicated
+	// routers with the gateway routers
+	transitSwitchName = "ovn-kubevirt-join"
+	// dedicatedRouterExternalIDKey is set at the tenant dedicated router
+	// and its SNAT
+	dedicatedRouterExternalIDKey = "ovn-kubevirt/dedicated-router"
+)
+
+func tenantRouterName(network string) string {
+	return "tenant_" + network
+}
+
+// The transit ports of the dedicated routers and the gateway routers have
+// different prefixes so a network and a node with the same name do not
+// collide at the transit switch
+func tenantToJoinPortName(network string) string {
+	return "rtoj-" + network
+}
+
+func joinToTenantPortName(network string) string {
+	return "jtor-" + network
+}
+
+func gwToTransitPortName(node string) string {
+	return "gtoj-" + node
+}
+
+func transitToGwPortName(node string) string {
+	return "jtog-" + node
+}
+
+// legacyTransitPorts returns the transit router port, and its transit switch
+// port, created with the former name if there is no port with the new one,
+// so they are renamed keeping their address and MAC. The router port has to
+// be owned by the network or node, the former names could collide.
+func legacyTransitPorts(nbcli ovsclient.Client, name, legacyName string, isOwned func(*nbdb.LogicalRouterPort) bool) (*nbdb.LogicalRouterPort, *nbdb.LogicalSwitchPort, error) {
+	if _, err := libovsdbops.GetLogicalRouterPort(nbcli, &nbdb.LogicalRouterPort{Name: name}); err == nil {
+		return nil, nil, nil
+	} else if !errors.Is(err, ovsclient.ErrNotFound) {
+		return nil, nil, fmt.Errorf("failed getting router port %s: %v", name, err)
+	}
+	lrp, err := libovsdbops.GetLogicalRouterPort(nbcli, &nbdb.LogicalRouterPort{Name: legacyName})
+	if errors.Is(err, ovsclient.ErrNotFound) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed getting router port %s: %v", legacyName, err)
+	}
+	if !isOwned(lrp) || len(lrp.Networks) == 0 {
+		return nil, nil, nil
+	}
+	lsps := []nbdb.LogicalSwitchPort{}
+	if err := nbcli.WhereCache(func(item *nbdb.LogicalSwitchPort) bool {
+		return item.Type == "router" && item.Options["router-port"] == legacyName
+	}).List(context.Background(), &lsps); err != nil {
+		return nil, nil, fmt.Errorf("failed looking for switch port of %s: %v", legacyName, err)
+	}
+	if len(lsps) == 0 {
+		return lrp, nil, nil
+	}
+	return lrp, &lsps[0], nil
+}
+
+// isDedicatedRouterNetwork returns true if the tenant network has its own
+// router connected to the gateway routers through the transit switch
+func isDedicatedRouterNetwork(nbcli ovsclient.Client, network string) (bool, error) {
+	routers, err := libovsdbops.FindLogicalRoutersWithPredicate(nbcli, func(item *nbdb.LogicalRouter) bool {
+		return item.ExternalIDs[dedicatedRouterExternalIDKey] != "" && item.ExternalIDs[networkExternalIDKey] == network
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed looking for network %s dedicated router: %v", network, err)
+	}
+	return len(routers) > 0, nil
+}
+
+// gatewayRouterAddress returns the nexthop to reach the node gateway router
+// from the tenant network router
+func gatewayRouterAddress(nbcli ovsclient.Client, network, node string) (string, error) {
+	dedicated, err := isDedicatedRouterNetwork(nbcli, network)
+	if err != nil {
+		return "", err
+	}
+	if !dedicated {
+		return gatewayRouterJoinAddress(nbcli, node)
+	}
+	// Dedicated gateway routers are connected directly to the dedicated
+	// router instead of through the transit switch
+	gwPortName := gwToJoinPortName(gatewayRouterName(network, node))
+	if _, err := libovsdbops.GetLogicalRouterPort(nbcli, &nbdb.LogicalRouterPort{Name: gwPortName}); err == nil {
+		return logicalRouterPortAddress(nbcli, gwPortName)
+	} else if !errors.Is(err, ovsclient.ErrNotFound) {
+		return "", fmt.Errorf("failed getting router port %s: %v", gwPortName, err)
+	}
+	gwPortName = gwToTransitPortName(node)
+	if _, err := libovsdbops.GetLogicalRouterPort(nbcli, &nbdb.LogicalRouterPort{Name: gwPortName}); errors.Is(err, ovsclient.ErrNotFound) {
+		// Not renamed yet
+		gwPortName = gwToJoinPortName(node)
+	}
+	return logicalRouterPortAddress(nbcli, gwPortName)
+}
+
+// logicalRouterPortAddress returns the first address of the router port
+func logicalRouterPortAddress(nbcli ovsclient.Client, name string) (string, error) {
+	lrp, err := libovsdbops.GetLogicalRouterPort(nbcli, &nbdb.LogicalRouterPort{Name: name})
+	if err != nil {
+		return "", fmt.Errorf("failed getting router port %s: %v", name, err)
+	}
+	if len(lrp.Networks) == 0 {
+		return "", fmt.Errorf("missing address at router port %s", name)
+	}
+	ip, _, err := net.ParseCIDR(lrp.Networks[0])
+	if err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+// addTransitPort adds the dedicated router port to the transit switch, the
+// address is kept if the port already exists
+func (j *JoinRouter) addTransitPort(ctx *CmdContext) error {
+	name := tenantToJoinPortName(ctx.conf.Name)
+	// The former name had the gateway router transit port format
+	legacyLRP, legacyLSP, err := legacyTransitPorts(ctx.nbcli, name, gwToJoinPortName(ctx.conf.Name), func(item *nbdb.LogicalRouterPort) bool {
+		return item.ExternalIDs[networkExternalIDKey] == ctx.conf.Name && item.ExternalIDs[nodeExternalIDKey] == ""
+	})
+	if err != nil {
+		return err
+	}
+	j.transitPort, err = transitRouterPort(ctx.nbcli, ctx.conf.transitSubnet(), j.lr.Name, name, "network/"+ctx.conf.Name, nil, legacyLRP)
+	if err != nil {
+		return err
+	}
+	j.transitPort.ExternalIDs = map[string]string{
+		networkExternalIDKey: ctx.conf.Name,
+	}
+	j.legacyTransitLSP = legacyLSP
+	j.tenantPorts[name] = j.transitPort
+	return nil
+}
+
+// transitRouterPort returns the router port connected to the transit switch,
+// with the address and MAC of the legacy port if it's renamed
+func transitRouterPort(nbcli ovsclient.Client, subnet, routerName, name, key string, allocated []string, legacy *nbdb.LogicalRouterPort) (*nbdb.LogicalRouterPort, error) {
+	lrp := &nbdb.LogicalRouterPort{
+		Name:    name,
+		Enabled: &enabled,
+	}
+	if legacy != nil {
+		lrp.UUID = legacy.UUID
+		lrp.MAC = legacy.MAC
+		lrp.Networks = []string{legacy.Networks[0]}
+		return lrp, nil
+	}
+	address, err := transitPortAddress(nbcli, subnet, name, key, allocated)
+	if err != nil {
+		return nil, err
+	}
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil, err
+	}
+	lrp.MAC, err = routerPortMAC(nbcli, routerName, name, ip)
+	if err != nil {
+		return nil, err
+	}
+	lrp.Networks = []string{address}
+	return lrp, nil
+}
+
+// ensureTransit connects the dedicated router and all the gateway routers to
+// the transit switch, the dedicated router port is a distributed gateway
+// port so the tenant subnet can be masqueraded with its address.
+func (j *JoinRouter) ensureTransit(ctx *CmdContext, t *nbTxn) error {
+	lsps := []*nbdb.LogicalSwitchPort{
+		{
+			UUID:      legacySwitchPortUUID(j.legacyTransitLSP),
+			Name:      joinToTenantPortName(ctx.conf.Name),
+			Type:      "router",
+			Addresses: []string{"router"},
+			Enabled:   &enabled,
+			Options: map[string]string{
+				"router-port": j.transitPort.Name,
+			},
+			ExternalIDs: map[string]string{
+				networkExternalIDKey: ctx.conf.Name,
+			},
+		},
+	}
+
+	nodes, err := nodes(ctx)
+	if err != nil {
+		return err
+	}
+	// The addresses allocated at this transaction are not at the cache
+	allocated := []string{j.transitPort.Networks[0]}
+	for _, node := range nodes {
+		// The gateway router transit ports are shared by all the dedicated
+		// routers so they are owned by the node instead of the network
+		transitExternalIDs := map[string]string{
+			dedicatedRouterExternalIDKey: "true",
+			nodeExternalIDKey:            node.Name,
+		}
+		gwPortName := gwToTransitPortName(node.Name)
+		legacyLRP, legacyLSP, err := legacyTransitPorts(ctx.nbcli, gwPortName, gwToJoinPortName(node.Name), func(item *nbdb.LogicalRouterPort) bool {
+			return item.ExternalIDs[dedicatedRouterExternalIDKey] != "" && item.ExternalIDs[nodeExternalIDKey] == node.Name
+		})
+		if err != nil {
+			return err
+		}
+		gwRouter := &nbdb.LogicalRouter{Name: ovnktypes.GWRouterPrefix + node.Name}
+		gwPort, err := transitRouterPort(ctx.nbcli, ctx.conf.transitSubnet(), gwRouter.Name, gwPortName, "node/"+node.Name, allocated, legacyLRP)
+		if err != nil {
+			return err
+		}
+		gwPort.ExternalIDs = transitExternalIDs
+		allocated = append(allocated, gwPort.Networks[0])
+		ip, _, err := net.ParseCIDR(gwPort.Networks[0])
+		if err != nil {
+			return err
+		}
+		if err := t.ensureRouterPort(gwRouter.Name, gwPort); err != nil {
+			return fmt.Errorf("failed ensuring gateway router %s transit port: %v", gwRouter.Name, err)
+		}
+		j.gwAddresses[node.Name] = ip.String()
+		lsps = append(lsps, &nbdb.LogicalSwitchPort{
+			UUID:      legacySwitchPortUUID(legacyLSP),
+			Name:      transitToGwPortName(node.Name),
+			Type:      "router",
+			Addresses: []string{"router"},
+			Enabled:   &enabled,
+			Options: map[string]string{
+				"router-port": gwPortName,
+			},
+			ExternalIDs: transitExternalIDs,
+		})
+	}
+
+	transitSwitch := &nbdb.LogicalSwitch{
+		Name: transitSwitchName,
+		ExternalIDs: map[string]string{
+			dedicatedRouterExternalIDKey: "true",
+		},
+	}
+	if err := t.ensureSwitch(transitSwitch); err != nil {
+		return fmt.Errorf("failed ensuring transit switch: %v", err)
+	}
+	for _, lsp := range lsps {
+		if err := t.ensureSwitchPort(transitSwitch.Name, lsp); err != nil {
+			return fmt.Errorf("failed ensuring transit switch: %v", err)
+		}
+	}
+
+	if err := j.ensureGatewayChassis(ctx, t); err != nil {
+		return err
+	}
+
+	if !ctx.conf.masquerade() {
+		return nil
+	}
+
+	transitIP, _, err := net.ParseCIDR(j.transitPort.Networks[0])
+	if err != nil {
+		return err
+	}
+	masqueradeNAT := &nbdb.NAT{
+		ExternalIP: transitIP.String(),
+		LogicalIP:  ctx.conf.Subnet,
+		Type:       nbdb.NATTypeSNAT,
+		Options: map[string]string{
+			"stateless": "false",
+		},
+		ExternalIDs: map[string]string{
+			networkExternalIDKey:         ctx.conf.Name,
+			dedicatedRouterExternalIDKey: "true",
+		},
+	}
+	predicate := func(item *nbdb.NAT) bool {
+		return item.Type == masqueradeNAT.Type && item.ExternalIDs[dedicatedRouterExternalIDKey] != "" &&
+			item.ExternalIDs[networkExternalIDKey] == ctx.conf.Name
+	}
+	if err := t.ensureRouterNAT(j.lr.Name, masqueradeNAT, predicate); err != nil {
+		return fmt.Errorf("failed ensuring tenant subnet masquerade at dedicated router: %v", err)
+	}
+	return nil
+}
+
+func legacySwitchPortUUID(lsp *nbdb.LogicalSwitchPort) string {
+	if lsp == nil {
+		return ""
+	}
+	return lsp.UUID
+}
+
+// ensureGatewayChassis schedules the dedicated router transit port at all
+// the chassis, so it fails over if the active one is down
+func (j *JoinRouter) ensureGatewayChassis(ctx *CmdContext, t *nbTxn) error {
+	chassis, err := libovsdbops.ListChassis(ctx.sbcli)
+	if err != nil {
+		return fmt.Errorf("failed listing chassis: %v", err)
+	}
+	if len(chassis) == 0 {
+		return fmt.Errorf("missing chassis for the dedicated router transit port")
+	}
+	sort.Slice(chassis, func(i, k int) bool { return chassis[i].Hostname < chassis[k].Hostname })
+
+	existing := []nbdb.GatewayChassis{}
+	if err := ctx.nbcli.WhereCache(func(item *nbdb.GatewayChassis) bool {
+		return strings.HasPrefix(item.Name, j.transitPort.Name+"_")
+	}).List(context.Background(), &existing); err != nil {
+		return fmt.Errorf("failed looking for gateway chassis: %v", err)
+	}
+	existingByName := map[string]string{}
+	for _, gc := range existing {
+		existingByName[gc.Name] = gc.UUID
+	}
+
+	ops := []ovsdb.Operation{}
+	lrp := &nbdb.LogicalRouterPort{UUID: j.transitPort.UUID, Name: j.transitPort.Name}
+	for i, c := range chassis {
+		gc := &nbdb.GatewayChassis{
+			Name:        j.transitPort.Name + "_" + c.Name,
+			ChassisName: c.Name,
+			Priority:    len(chassis) - i,
+			ExternalIDs: map[string]string{
+				networkExternalIDKey: ctx.conf.Name,
+			},
+		}
+		if uuid, ok := existingByName[gc.Name]; ok {
+			gc.UUID = uuid
+			updateOps, err := ctx.nbcli.Where(gc).Update(gc, &gc.ChassisName, &gc.Priority, &gc.ExternalIDs)
+			if err != nil {
+				return fmt.Errorf("failed updating gateway chassis %s: %v", gc.Name, err)
+			}
+			ops = append(ops, updateOps...)
+		} else {
+			// Gateway chassis is not a root table so it has to be created
+			// at the same transaction that references it
+			gc.UUID = t.namedUUID()
+			createOps, err := ctx.nbcli.Create(gc)
+			if err != nil {
+				return fmt.Errorf("failed creating gateway chassis %s: %v", gc.Name, err)
+			}
+			ops = append(ops, createOps...)
+		}
+		lrp.GatewayChassis = append(lrp.GatewayChassis, gc.UUID)
+	}
+	updateOps, err := ctx.nbcli.Where(lrp).Update(lrp, &lrp.GatewayChassis)
+	if err != nil {
+		return fmt.Errorf("failed updating %s gateway chassis: %v", lrp.Name, err)
+	}
+	t.ops = append(t.ops, append(ops, updateOps...)...)
+	return nil
+}
+
+// transitPortAddress returns the address of the router port if it exists,
+// otherwise it allocates a free address of the transit subnet, not at the
+// allocated ones, starting at the key hash, so concurrent allocations for
+// different keys are unlikely to collide.
+func transitPortAddress(nbcli ovsclient.Client, subnet, portName, key string, allocated []string) (string, error) {
+	lrp, err := libovsdbops.GetLogicalRouterPort(nbcli, &nbdb.LogicalRouterPort{Name: portName})
+	if err == nil && len(lrp.Networks) > 0 {
+		return lrp.Networks[0], nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return "", fmt.Errorf("invalid transit subnet %q: %v", subnet, err)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits != 32 || bits-ones < 2 {
+		return "", fmt.Errorf("transit subnet %s has to be an IPv4 subnet with at least two addresses", subnet)
+	}
+
+	lrps := []nbdb.LogicalRouterPort{}
+	if err := nbcli.List(context.Background(), &lrps); err != nil {
+		return "", fmt.Errorf("failed listing router ports: %v", err)
+	}
+	used := map[uint32]bool{}
+	for _, lrp := range append(lrps, nbdb.LogicalRouterPort{Networks: allocated}) {
+		for _, network := range lrp.Networks {
+			ip, _, err := net.ParseCIDR(network)
+			if err != nil || ip.To4() == nil || !ipNet.Contains(ip) {
+				continue
+			}
+			used[binary.BigEndian.Uint32(ip.To4())] = true
+		}
+	}
+
+	// Skip the network and broadcast addresses
+	first := binary.BigEndian.Uint32(ipNet.IP.To4()) + 1
+	hosts := uint32(1)<<(bits-ones) - 2
+	slot, ok := freeSlot(hosts, key, func(slot uint32) bool { return used[first+slot] })
+	if !ok {
+		return "", fmt.Errorf("transit subnet %s is exhausted", subnet)
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, first+slot)
+	return fmt.Sprintf("%s/%d", ip, ones), nil
+}
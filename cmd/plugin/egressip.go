@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/ovn-org/libovsdb/ovsdb"
+	corev1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	ovsclient "github.com/ovn-org/libovsdb/client"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/libovsdbops"
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+	ovnktypes "github.com/ovn-org/ovn-kubernetes/go-controller/pkg/types"
+)
+
+// egressIP contains the egress configuration of a tenant network, it's
+// stored at the external ids of the egress NAT so the controller can move it
+// to a different gateway router without access to the network configuration.
+type egressIP struct {
+	network string
+	ip      string
+	subnet  string
+	nodes   []string
+}
+
+func egressIPFromConf(conf *PluginConf, subnet string) *egressIP {
+	return &egressIP{
+		network: conf.Name,
+		ip:      conf.EgressIP,
+		subnet:  subnet,
+		nodes:   conf.EgressNodes,
+	}
+}
+
+func egressIPFromNAT(nat *nbdb.NAT) *egressIP {
+	e := &egressIP{
+		network: nat.ExternalIDs[networkExternalIDKey],
+		ip:      nat.ExternalIP,
+		subnet:  nat.LogicalIP,
+	}
+	if nodes := nat.ExternalIDs[egressNodesExternalIDKey]; nodes != "" {
+		e.nodes = strings.Split(nodes, ",")
+	}
+	return e
+}
+
+func (e *egressIP) nat() *nbdb.NAT {
+	return &nbdb.NAT{
+		ExternalIP: e.ip,
+		LogicalIP:  e.subnet,
+		Type:       nbdb.NATTypeSNAT,
+		Options: map[string]string{
+			"stateless": "false",
+		},
+		ExternalIDs: map[string]string{
+			networkExternalIDKey:     e.network,
+			egressNodesExternalIDKey: strings.Join(e.nodes, ","),
+		},
+	}
+}
+
+// isCandidate returns true if the node can be used as egress gateway, if
+// there is no egress nodes configured all the nodes are candidates
+func (e *egressIP) isCandidate(nodeName string) bool {
+	return len(e.nodes) == 0 || containsString(e.nodes, nodeName)
+}
+
+// selectNode keeps the current egress node if it's ready and still a
+// candidate, otherwise it returns the first ready candidate.
+func (e *egressIP) selectNode(nodes []corev1.Node, current string) (string, error) {
+	candidates := []string{}
+	for _, node := range nodes {
+		if e.isCandidate(node.Name) && isNodeReady(&node) {
+			if node.Name == current {
+				return current, nil
+			}
+			candidates = append(candidates, node.Name)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("missing ready egress node for network %s", e.network)
+	}
+	sort.Strings(candidates)
+	return candidates[0], nil
+}
+
+func isNodeReady(node *corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// ensureEgressIP selects the egress node for the tenant network and moves
+// the egress SNAT there if needed, it returns the selected node.
+func ensureEgressIP(ctx *CmdContext, t *nbTxn) (string, error) {
+	egress := egressIPFromConf(ctx.conf, ctx.joinRouter.sourceSubnet(ctx))
+	if net.ParseIP(egress.ip) == nil {
+		return "", fmt.Errorf("invalid egress ip %q", egress.ip)
+	}
+
+	currentNode, err := egressNode(ctx.nbcli, egress.network)
+	if err != nil {
+		return "", err
+	}
+
+	nodes, err := nodes(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	node, err := egress.selectNode(nodes, currentNode)
+	if err != nil {
+		return "", err
+	}
+
+	gwAddress, err := ctx.joinRouter.gatewayAddress(ctx, node)
+	if err != nil {
+		return "", err
+	}
+	ops, err := moveEgressIPOps(ctx.nbcli, t.ops, egress, node, gwAddress)
+	if err != nil {
+		return "", err
+	}
+	t.ops = ops
+	return node, nil
+}
+
+// egressNode returns the node whose gateway router has the egress SNAT of the
+// network or empty if there is none
+func egressNode(nbcli ovsclient.Client, network string) (string, error) {
+	nats, err := findEgressNATs(nbcli, network)
+	if err != nil {
+		return "", err
+	}
+	for _, nat := range nats {
+		routers, err := natRouters(nbcli, nat)
+		if err != nil {
+			return "", err
+		}
+		for _, router := range routers {
+			return strings.TrimPrefix(router.Name, ovnktypes.GWRouterPrefix), nil
+		}
+	}
+	return "", nil
+}
+
+func findEgressNATs(nbcli ovsclient.Client, network string) ([]*nbdb.NAT, error) {
+	nats, err := libovsdbops.FindNATsWithPredicate(nbcli, func(item *nbdb.NAT) bool {
+		_, isEgress := item.ExternalIDs[egressNodesExternalIDKey]
+		return isEgress && item.Type == nbdb.NATTypeSNAT && item.ExternalIDs[networkExternalIDKey] == network
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed looking for egress nats of network %s: %v", network, err)
+	}
+	return nats, nil
+}
+
+func natRouters(nbcli ovsclient.Client, nat *nbdb.NAT) ([]*nbdb.LogicalRouter, error) {
+	routers, err := libovsdbops.FindLogicalRoutersWithPredicate(nbcli, func(item *nbdb.LogicalRouter) bool {
+		for _, uuid := range item.Nat {
+			if uuid == nat.UUID {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed looking for routers with nat %s: %v", nat.UUID, err)
+	}
+	return routers, nil
+}
+
+// moveEgressIP configures the egress SNAT at the node gateway router,
+// removing it from the rest of them, and reroutes the tenant network VMs to
+// it, all at the same transaction.
+func moveEgressIP(nbcli ovsclient.Client, egress *egressIP, node string) error {
+	gwAddress, err := gatewayRouterAddress(nbcli, egress.network, node)
+	if err != nil {
+		return err
+	}
+	ops, err := moveEgressIPOps(nbcli, nil, egress, node, gwAddress)
+	if err != nil {
+		return err
+	}
+	if _, err := libovsdbops.TransactAndCheck(nbcli, ops); err != nil {
+		return fmt.Errorf("failed moving egress ip %s to %s: %v", egress.ip, node, err)
+	}
+	return nil
+}
+
+// moveEgressIPOps returns the operations to move the egress SNAT to the node
+// gateway router and reroute the tenant network VMs to gwAddress
+func moveEgressIPOps(nbcli ovsclient.Client, ops []ovsdb.Operation, egress *egressIP, node, gwAddress string) ([]ovsdb.Operation, error) {
+	gwRouter := &nbdb.LogicalRouter{Name: ovnktypes.GWRouterPrefix + node}
+
+	// Remove the egress SNAT from the previous gateway router and the node ip
+	// masquerade SNATs in case the egress ip has being configured after them.
+	ops, err := deleteNetworkSNATsOps(nbcli, ops, egress.network, func(nat *nbdb.NAT, router *nbdb.LogicalRouter) bool {
+		_, isEgress := nat.ExternalIDs[egressNodesExternalIDKey]
+		return isEgress && nat.ExternalIP == egress.ip && router.Name == gwRouter.Name
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ops, err = libovsdbops.CreateOrUpdateNATsOps(nbcli, ops, gwRouter, egress.nat())
+	if err != nil {
+		return nil, fmt.Errorf("failed adding egress ip to %s: %v", gwRouter.Name, err)
+	}
+
+	ops, err = updateRerouteToGwPoliciesOps(nbcli, ops, egress.network, gwAddress)
+	if err != nil {
+		return nil, err
+	}
+	return updateSourceRoutesToGwOps(nbcli, ops, egress.network, gwAddress)
+}
+
+// deleteNetworkSNATsOps removes the tenant network SNATs from all the gateway
+// routers, except the ones for which keep returns true
+func deleteNetworkSNATsOps(nbcli ovsclient.Client, ops []ovsdb.Operation, network string, keep func(*nbdb.NAT, *nbdb.LogicalRouter) bool) ([]ovsdb.Operation, error) {
+	nats, err := libovsdbops.FindNATsWithPredicate(nbcli, func(item *nbdb.NAT) bool {
+		_, isDedicatedRouter := item.ExternalIDs[dedicatedRouterExternalIDKey]
+		return !isDedicatedRouter && item.Type == nbdb.NATTypeSNAT && item.ExternalIDs[networkExternalIDKey] == network
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed looking for snats of network %s: %v", network, err)
+	}
+	for _, nat := range nats {
+		routers, err := natRouters(nbcli, nat)
+		if err != nil {
+			return nil, err
+		}
+		for _, router := range routers {
+			if keep != nil && keep(nat, router) {
+				continue
+			}
+			ops, err = libovsdbops.DeleteNATsOps(nbcli, ops, router, nat)
+			if err != nil {
+				return nil, fmt.Errorf("failed removing snat from %s: %v", router.Name, err)
+			}
+		}
+	}
+	return ops, nil
+}
+
+// updateRerouteToGwPoliciesOps changes the nexthop of the reroute policies of
+// the tenant network VMs
+func updateRerouteToGwPoliciesOps(nbcli ovsclient.Client, ops []ovsdb.Operation, network, gwAddress string) ([]ovsdb.Operation, error) {
+	policies, err := libovsdbops.FindLogicalRouterPoliciesWithPredicate(nbcli, func(item *nbdb.LogicalRouterPolicy) bool {
+		return item.Action == nbdb.LogicalRouterPolicyActionReroute && item.ExternalIDs[networkExternalIDKey] == network
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed looking for reroute policies of network %s: %v", network, err)
+	}
+	for _, policy := range policies {
+		if len(policy.Nexthops) == 1 && policy.Nexthops[0] == gwAddress {
+			continue
+		}
+		policy.Nexthops = []string{gwAddress}
+		updateOps, err := nbcli.Where(policy).Update(policy, &policy.Nexthops)
+		if err != nil {
+			return nil, fmt.Errorf("failed updating reroute policy nexthop: %v", err)
+		}
+		ops = append(ops, updateOps...)
+	}
+	return ops, nil
+}
+
+// updateSourceRoutesToGwOps changes the nexthop of the src-ip routes of the
+// tenant network VMs
+func updateSourceRoutesToGwOps(nbcli ovsclient.Client, ops []ovsdb.Operation, network, gwAddress string) ([]ovsdb.Operation, error) {
+	routes, err := libovsdbops.FindLogicalRouterStaticRoutesWithPredicate(nbcli, func(item *nbdb.LogicalRouterStaticRoute) bool {
+		return isVMSourceRoute(item, network)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed looking for source routes of network %s: %v", network, err)
+	}
+	for _, route := range routes {
+		if route.Nexthop == gwAddress {
+			continue
+		}
+		route.Nexthop = gwAddress
+		updateOps, err := nbcli.Where(route).Update(route, &route.Nexthop)
+		if err != nil {
+			return nil, fmt.Errorf("failed updating source route nexthop: %v", err)
+		}
+		ops = append(ops, updateOps...)
+	}
+	return ops, nil
+}
+
+// reconcileEgressIPs moves the egress ips configured at the node gateway
+// router to a different node if it's not ready anymore, a network that cannot
+// be moved doesn't prevent moving the rest of them
+func reconcileEgressIPs(ctx context.Context, nbcli ovsclient.Client, nodes []corev1.Node) error {
+	nats, err := libovsdbops.FindNATsWithPredicate(nbcli, func(item *nbdb.NAT) bool {
+		_, isEgress := item.ExternalIDs[egressNodesExternalIDKey]
+		return isEgress
+	})
+	if err != nil {
+		return fmt.Errorf("failed looking for egress nats: %v", err)
+	}
+
+	// A network may have more than one egress NAT while it's being moved, it
+	// is reconciled once
+	egresses := map[string]*egressIP{}
+	for _, nat := range nats {
+		egress := egressIPFromNAT(nat)
+		if _, ok := egresses[egress.network]; !ok {
+			egresses[egress.network] = egress
+		}
+	}
+	networks := make([]string, 0, len(egresses))
+	for network := range egresses {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+
+	errs := []error{}
+	for _, network := range networks {
+		if err := reconcileEgressIP(nbcli, egresses[network], nodes); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func reconcileEgressIP(nbcli ovsclient.Client, egress *egressIP, nodes []corev1.Node) error {
+	currentNode, err := egressNode(nbcli, egress.network)
+	if err != nil {
+		return err
+	}
+	node, err := egress.selectNode(nodes, currentNode)
+	if err != nil {
+		return err
+	}
+	if node == currentNode {
+		return nil
+	}
+	return moveEgressIP(nbcli, egress, node)
+}
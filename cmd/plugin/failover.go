@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/ovn-org/libovsdb/ovsdb"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	ovsclient "github.com/ovn-org/libovsdb/client"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/libovsdbops"
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+	ovnktypes "github.com/ovn-org/ovn-kubernetes/go-controller/pkg/types"
+
+	k8sclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// failoverExternalIDKey is set at the masquerade NATs copied to the gateway
+// router the VMs have been moved to with the replaced node
+const failoverExternalIDKey = "ovn-kubevirt/failover-from"
+
+// failover moves the VMs n/s traffic out of the gateway routers of the nodes
+// that are not ready, and back once they are ready again. The tenant networks
+// with egress ip are moved by the egress ip reconciliation instead.
+type failover struct {
+	nbcli ovsclient.Client
+	// ready are the names of the ready nodes sorted
+	ready   []string
+	isReady map[string]bool
+	// targets are the failover node and nexthop by router, network and
+	// gateway node, so they are computed once for all the VMs
+	targets map[string]failoverTarget
+	egress  map[string]bool
+	// masquerades are the gateway nodes that have been replaced by network
+	masquerades map[string]map[string]string
+	ops         []ovsdb.Operation
+}
+
+type failoverTarget struct {
+	node    string
+	address string
+}
+
+// failoverVM is a VM whose n/s traffic has been moved to a different node
+type failoverVM struct {
+	network string
+	vmi     string
+	address string
+	node    string
+}
+
+func reconcileGatewayFailover(ctx context.Context, k8scli k8sclient.Client, nbcli ovsclient.Client, nodes []corev1.Node) error {
+	f := &failover{
+		nbcli:       nbcli,
+		isReady:     map[string]bool{},
+		targets:     map[string]failoverTarget{},
+		egress:      map[string]bool{},
+		masquerades: map[string]map[string]string{},
+	}
+	for i := range nodes {
+		if isNodeReady(&nodes[i]) {
+			f.ready = append(f.ready, nodes[i].Name)
+			f.isReady[nodes[i].Name] = true
+		}
+	}
+	sort.Strings(f.ready)
+
+	routers := []nbdb.LogicalRouter{}
+	if err := nbcli.List(ctx, &routers); err != nil {
+		return fmt.Errorf("failed listing routers: %v", err)
+	}
+	moved := []failoverVM{}
+	for i := range routers {
+		vms, err := f.failoverRouter(&routers[i])
+		if err != nil {
+			return err
+		}
+		moved = append(moved, vms...)
+	}
+	if err := f.masqueradeOps(); err != nil {
+		return err
+	}
+
+	// The floating ips follow the VM n/s traffic to the new gateway router
+	for _, vm := range moved {
+		// Plain pods have no floating ips
+		if vm.vmi == "" {
+			continue
+		}
+		namespace, name, _ := strings.Cut(vm.vmi, "/")
+		vmi := &kubevirtv1.VirtualMachineInstance{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}
+		fips, err := vmiFloatingIPs(ctx, k8scli, vmi)
+		if err != nil {
+			return err
+		}
+		for _, fip := range fips {
+			// The floating ip is implemented for one of the VMI interfaces
+			if fip.Spec.Network != vm.network || fip.Status.LogicalIP != vm.address {
+				continue
+			}
+			f.ops, err = ensureFloatingIPOps(nbcli, f.ops, &fip, vm.address, vm.node)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(f.ops) == 0 {
+		return nil
+	}
+	if _, err := libovsdbops.TransactAndCheck(nbcli, f.ops); err != nil {
+		return fmt.Errorf("failed moving VMs to ready gateway routers: %v", err)
+	}
+	return nil
+}
+
+// failoverRouter updates the nexthop of the router VM reroute policies and
+// source routes, the ones created before they had the gateway node are not
+// moved
+func (f *failover) failoverRouter(lr *nbdb.LogicalRouter) ([]failoverVM, error) {
+	moved := []failoverVM{}
+
+	policies, err := libovsdbops.FindLogicalRouterPoliciesWithPredicate(f.nbcli, func(item *nbdb.LogicalRouterPolicy) bool {
+		_, ok := item.ExternalIDs[gatewayNodeExternalIDKey]
+		return ok && containsString(lr.Policies, item.UUID) && item.Action == nbdb.LogicalRouterPolicyActionReroute
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed looking for router %s reroute policies: %v", lr.Name, err)
+	}
+	for _, policy := range policies {
+		target, err := f.target(lr, policy.ExternalIDs)
+		if err != nil {
+			return nil, err
+		}
+		if target == nil || (len(policy.Nexthops) == 1 && policy.Nexthops[0] == target.address) {
+			continue
+		}
+		policy.Nexthops = []string{target.address}
+		ops, err := f.nbcli.Where(policy).Update(policy, &policy.Nexthops)
+		if err != nil {
+			return nil, fmt.Errorf("failed updating reroute policy nexthop: %v", err)
+		}
+		f.ops = append(f.ops, ops...)
+		moved = append(moved, failoverVM{
+			network: policy.ExternalIDs[networkExternalIDKey],
+			vmi:     policy.ExternalIDs[vmiExternalIDKey],
+			address: strings.TrimPrefix(policy.Match, "ip4.src == "),
+			node:    target.node,
+		})
+	}
+
+	routes, err := libovsdbops.FindLogicalRouterStaticRoutesWithPredicate(f.nbcli, func(item *nbdb.LogicalRouterStaticRoute) bool {
+		_, ok := item.ExternalIDs[gatewayNodeExternalIDKey]
+		return ok && containsString(lr.StaticRoutes, item.UUID) && isVMSourceRoute(item, item.ExternalIDs[networkExternalIDKey])
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed looking for router %s source routes: %v", lr.Name, err)
+	}
+	for _, route := range routes {
+		target, err := f.target(lr, route.ExternalIDs)
+		if err != nil {
+			return nil, err
+		}
+		if target == nil || route.Nexthop == target.address {
+			continue
+		}
+		route.Nexthop = target.address
+		ops, err := f.nbcli.Where(route).Update(route, &route.Nexthop)
+		if err != nil {
+			return nil, fmt.Errorf("failed updating source route nexthop: %v", err)
+		}
+		f.ops = append(f.ops, ops...)
+		moved = append(moved, failoverVM{
+			network: route.ExternalIDs[networkExternalIDKey],
+			vmi:     route.ExternalIDs[vmiExternalIDKey],
+			address: route.IPPrefix,
+			node:    target.node,
+		})
+	}
+	return moved, nil
+}
+
+// target returns the gateway node of the VM if it's ready, otherwise the
+// first ready node with a gateway router reachable from the VM router. It
+// returns nil if the VM is not moved.
+func (f *failover) target(lr *nbdb.LogicalRouter, externalIDs map[string]string) (*failoverTarget, error) {
+	network := externalIDs[networkExternalIDKey]
+	gatewayNode := externalIDs[gatewayNodeExternalIDKey]
+
+	egress, ok := f.egress[network]
+	if !ok {
+		nats, err := findEgressNATs(f.nbcli, network)
+		if err != nil {
+			return nil, err
+		}
+		egress = len(nats) > 0
+		f.egress[network] = egress
+	}
+	if egress {
+		return nil, nil
+	}
+
+	key := lr.UUID + "/" + network + "/" + gatewayNode
+	if target, ok := f.targets[key]; ok {
+		if target.node == "" {
+			return nil, nil
+		}
+		return &target, nil
+	}
+
+	candidates := f.ready
+	if f.isReady[gatewayNode] {
+		candidates = append([]string{gatewayNode}, f.ready...)
+	}
+	target := failoverTarget{}
+	for _, node := range candidates {
+		// Nodes without gateway router for the network are skipped
+		address, err := gatewayRouterAddress(f.nbcli, network, node)
+		if err != nil {
+			continue
+		}
+		reachable, err := routerReaches(f.nbcli, lr, address)
+		if err != nil {
+			return nil, err
+		}
+		if reachable {
+			target = failoverTarget{node: node, address: address}
+			break
+		}
+	}
+	f.targets[key] = target
+	if target.node == "" {
+		return nil, nil
+	}
+	if target.node != gatewayNode {
+		if f.masquerades[network] == nil {
+			f.masquerades[network] = map[string]string{}
+		}
+		f.masquerades[network][gatewayNode] = target.node
+	}
+	return &target, nil
+}
+
+// routerReaches returns true if the address is at the subnet of one of the
+// router ports
+func routerReaches(nbcli ovsclient.Client, lr *nbdb.LogicalRouter, address string) (bool, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false, nil
+	}
+	lrps := []nbdb.LogicalRouterPort{}
+	if err := nbcli.WhereCache(func(item *nbdb.LogicalRouterPort) bool {
+		return containsString(lr.Ports, item.UUID)
+	}).List(context.Background(), &lrps); err != nil {
+		return false, fmt.Errorf("failed listing router %s ports: %v", lr.Name, err)
+	}
+	for _, lrp := range lrps {
+		for _, network := range lrp.Networks {
+			_, ipNet, err := net.ParseCIDR(network)
+			if err == nil && ipNet.Contains(ip) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// masqueradeOps masquerades the tenant networks at the node gateway routers
+// the VMs have been moved to, like at the replaced ones. The dedicated
+// gateway routers already masquerade the network.
+func (f *failover) masqueradeOps() error {
+	for network, replaced := range f.masquerades {
+		for from, to := range replaced {
+			nat, err := f.replacedMasqueradeNAT(network, from, to)
+			if err != nil {
+				return err
+			}
+			if nat == nil {
+				continue
+			}
+			if err := f.masqueradeAtNodeOps(nat, from, to); err != nil {
+				return err
+			}
+		}
+	}
+	return f.deleteStaleMasqueradesOps()
+}
+
+// deleteStaleMasqueradesOps removes the masquerade NATs copied to the node
+// gateway routers that no VM of the network is moved to anymore, like once
+// the replaced node is ready again
+func (f *failover) deleteStaleMasqueradesOps() error {
+	nats, err := libovsdbops.FindNATsWithPredicate(f.nbcli, func(item *nbdb.NAT) bool {
+		_, ok := item.ExternalIDs[failoverExternalIDKey]
+		return ok && item.Type == nbdb.NATTypeSNAT
+	})
+	if err != nil {
+		return fmt.Errorf("failed looking for failover masquerade nats: %v", err)
+	}
+	for _, nat := range nats {
+		if f.isMovedTo(nat.ExternalIDs[networkExternalIDKey], nat.ExternalIDs[nodeExternalIDKey]) {
+			continue
+		}
+		routers, err := natRouters(f.nbcli, nat)
+		if err != nil {
+			return err
+		}
+		for _, router := range routers {
+			f.ops, err = libovsdbops.DeleteNATsOps(f.nbcli, f.ops, router, nat)
+			if err != nil {
+				return fmt.Errorf("failed removing failover masquerade from %s: %v", router.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// isMovedTo returns true if VMs of the network are moved to the node
+func (f *failover) isMovedTo(network, node string) bool {
+	for _, to := range f.masquerades[network] {
+		if to == node {
+			return true
+		}
+	}
+	return false
+}
+
+// replacedMasqueradeNAT returns the network masquerade NAT of the replaced
+// node gateway router, or nil if the network is already masqueraded at the
+// target one
+func (f *failover) replacedMasqueradeNAT(network, from, to string) (*nbdb.NAT, error) {
+	nats, err := libovsdbops.FindNATsWithPredicate(f.nbcli, func(item *nbdb.NAT) bool {
+		_, isEgress := item.ExternalIDs[egressNodesExternalIDKey]
+		return !isEgress && item.Type == nbdb.NATTypeSNAT && item.ExternalIDs[networkExternalIDKey] == network &&
+			(item.ExternalIDs[nodeExternalIDKey] == from || item.ExternalIDs[nodeExternalIDKey] == to)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed looking for network %s masquerade nats: %v", network, err)
+	}
+	var replaced *nbdb.NAT
+	for _, nat := range nats {
+		routers, err := natRouters(f.nbcli, nat)
+		if err != nil {
+			return nil, err
+		}
+		for _, router := range routers {
+			switch router.Name {
+			case ovnktypes.GWRouterPrefix + to:
+				return nil, nil
+			case ovnktypes.GWRouterPrefix + from:
+				replaced = nat
+			}
+		}
+	}
+	return replaced, nil
+}
+
+// masqueradeAtNodeOps copies the masquerade NAT to the node gateway router
+// with its external address
+func (f *failover) masqueradeAtNodeOps(nat *nbdb.NAT, from, node string) error {
+	gwRouter := &nbdb.LogicalRouter{Name: ovnktypes.GWRouterPrefix + node}
+	externalIP, err := logicalRouterPortAddress(f.nbcli, ovnktypes.GWRouterToExtSwitchPrefix+gwRouter.Name)
+	if err != nil {
+		return err
+	}
+	masqueradeNAT := &nbdb.NAT{
+		ExternalIP: externalIP,
+		LogicalIP:  nat.LogicalIP,
+		Type:       nbdb.NATTypeSNAT,
+		Options:    nat.Options,
+		ExternalIDs: map[string]string{
+			networkExternalIDKey:  nat.ExternalIDs[networkExternalIDKey],
+			nodeExternalIDKey:     node,
+			failoverExternalIDKey: from,
+		},
+	}
+	f.ops, err = libovsdbops.CreateOrUpdateNATsOps(f.nbcli, f.ops, gwRouter, masqueradeNAT)
+	if err != nil {
+		return fmt.Errorf("failed masquerading network %s at %s: %v", nat.ExternalIDs[networkExternalIDKey], gwRouter.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ovn-org/libovsdb/ovsdb"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	ovsclient "github.com/ovn-org/libovsdb/client"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/libovsdbops"
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+	ovnktypes "github.com/ovn-org/ovn-kubernetes/go-controller/pkg/types"
+
+	k8sclient "sigs.k8s.io/controller-runtime/pkg/client"
+
+	ovnkubevirtv1alpha1 "github.com/qinqon/ovn-kubevirt/api/v1alpha1"
+)
+
+// ensureVMIFloatingIPs moves the floating ips of the VMI to its current
+// gateway router, plain pods have no floating ips. The gateway routers cannot
+// reach the VMs behind a dedicated router, the floating ip reconciler reports
+// it at the FloatingIP status instead of failing the VMI network setup.
+func ensureVMIFloatingIPs(ctx *CmdContext, t *nbTxn, vmAddress string) error {
+	if ctx.vmi == nil || ctx.conf.dedicatedRouter() {
+		return nil
+	}
+	fips, err := vmiFloatingIPs(context.Background(), ctx.k8scli, ctx.vmi)
+	if err != nil {
+		return err
+	}
+	for _, fip := range fips {
+		if fip.Spec.Network != ctx.conf.Name {
+			continue
+		}
+		ops, err := ensureFloatingIPOps(ctx.nbcli, t.ops, &fip, vmAddress, ctx.gatewayNode)
+		if err != nil {
+			return err
+		}
+		t.ops = ops
+	}
+	return nil
+}
+
+func vmiFloatingIPs(ctx context.Context, k8scli k8sclient.Client, vmi *kubevirtv1.VirtualMachineInstance) ([]ovnkubevirtv1alpha1.FloatingIP, error) {
+	fipList := &ovnkubevirtv1alpha1.FloatingIPList{}
+	if err := k8scli.List(ctx, fipList, k8sclient.InNamespace(vmi.Namespace)); err != nil {
+		return nil, fmt.Errorf("failed listing floating ips: %v", err)
+	}
+	fips := []ovnkubevirtv1alpha1.FloatingIP{}
+	for _, fip := range fipList.Items {
+		if fip.Spec.VMI == vmi.Name {
+			fips = append(fips, fip)
+		}
+	}
+	return fips, nil
+}
+
+func floatingIPKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// ensureFloatingIP configures a dnat_and_snat from the floating ip to the VM
+// address at the node gateway router and removes it from the rest of them
+func ensureFloatingIP(nbcli ovsclient.Client, fip *ovnkubevirtv1alpha1.FloatingIP, vmAddress, node string) error {
+	ops, err := ensureFloatingIPOps(nbcli, nil, fip, vmAddress, node)
+	if err != nil {
+		return err
+	}
+	if _, err := libovsdbops.TransactAndCheck(nbcli, ops); err != nil {
+		return fmt.Errorf("failed ensuring floating ip %s: %v", floatingIPKey(fip.Namespace, fip.Name), err)
+	}
+	return nil
+}
+
+// ensureFloatingIPOps returns the operations to move the floating ip NAT to
+// the node gateway router
+func ensureFloatingIPOps(nbcli ovsclient.Client, ops []ovsdb.Operation, fip *ovnkubevirtv1alpha1.FloatingIP, vmAddress, node string) ([]ovsdb.Operation, error) {
+	if net.ParseIP(fip.Spec.ExternalIP) == nil {
+		return nil, fmt.Errorf("invalid floating ip %q", fip.Spec.ExternalIP)
+	}
+	key := floatingIPKey(fip.Namespace, fip.Name)
+	gwRouter := &nbdb.LogicalRouter{Name: ovnktypes.GWRouterPrefix + node}
+	nat := &nbdb.NAT{
+		ExternalIP: fip.Spec.ExternalIP,
+		LogicalIP:  vmAddress,
+		Type:       nbdb.NATTypeDNATAndSNAT,
+		Options: map[string]string{
+			"stateless": "false",
+		},
+		ExternalIDs: map[string]string{
+			networkExternalIDKey:    fip.Spec.Network,
+			floatingIPExternalIDKey: key,
+		},
+	}
+
+	ops, err := deleteFloatingIPNATsOps(nbcli, ops, key, func(existing *nbdb.NAT, router *nbdb.LogicalRouter) bool {
+		return router.Name == gwRouter.Name && existing.ExternalIP == nat.ExternalIP && existing.LogicalIP == nat.LogicalIP
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ops, err = libovsdbops.CreateOrUpdateNATsOps(nbcli, ops, gwRouter, nat)
+	if err != nil {
+		return nil, fmt.Errorf("failed adding floating ip %s to %s: %v", key, gwRouter.Name, err)
+	}
+	return ops, nil
+}
+
+// deleteFloatingIPNATsOps removes the floating ip NATs from all the gateway
+// routers, except the ones for which keep returns true
+func deleteFloatingIPNATsOps(nbcli ovsclient.Client, ops []ovsdb.Operation, key string, keep func(*nbdb.NAT, *nbdb.LogicalRouter) bool) ([]ovsdb.Operation, error) {
+	nats, err := libovsdbops.FindNATsWithPredicate(nbcli, func(item *nbdb.NAT) bool {
+		return item.ExternalIDs[floatingIPExternalIDKey] == key
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed looking for floating ip %s nats: %v", key, err)
+	}
+	for _, nat := range nats {
+		routers, err := natRouters(nbcli, nat)
+		if err != nil {
+			return nil, err
+		}
+		for _, router := range routers {
+			if keep != nil && keep(nat, router) {
+				continue
+			}
+			ops, err = libovsdbops.DeleteNATsOps(nbcli, ops, router, nat)
+			if err != nil {
+				return nil, fmt.Errorf("failed removing floating ip %s from %s: %v", key, router.Name, err)
+			}
+		}
+	}
+	return ops, nil
+}
+
+func deleteFloatingIP(nbcli ovsclient.Client, key string) error {
+	ops, err := deleteFloatingIPNATsOps(nbcli, nil, key, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := libovsdbops.TransactAndCheck(nbcli, ops); err != nil {
+		return fmt.Errorf("failed deleting floating ip %s: %v", key, err)
+	}
+	return nil
+}
+
+// gatewayNodeForPort returns the node whose gateway router is the nexthop of
+// the VM port reroute policy or source route
+func gatewayNodeForPort(nbcli ovsclient.Client, network string, vmi *kubevirtv1.VirtualMachineInstance, lsp *nbdb.LogicalSwitchPort, vmAddress string) (string, error) {
+	owner := map[string]string{
+		portExternalIDKey: lsp.Name,
+		vmiExternalIDKey:  vmiKey(vmi),
+	}
+	nexthop, err := vmNexthop(nbcli, network, owner, vmAddress)
+	if err != nil {
+		return "", err
+	}
+
+	joinPortPrefix := ovnktypes.GWRouterToJoinSwitchPrefix + ovnktypes.GWRouterPrefix
+	lrps := []nbdb.LogicalRouterPort{}
+	if err := nbcli.WhereCache(func(item *nbdb.LogicalRouterPort) bool {
+		if !strings.HasPrefix(item.Name, joinPortPrefix) || len(item.Networks) == 0 {
+			return false
+		}
+		ip, _, err := net.ParseCIDR(item.Networks[0])
+		return err == nil && ip.String() == nexthop
+	}).List(context.Background(), &lrps); err != nil {
+		return "", fmt.Errorf("failed looking for gateway router port with %s: %v", nexthop, err)
+	}
+	if len(lrps) == 0 {
+		return "", fmt.Errorf("missing gateway router port with %s", nexthop)
+	}
+	return strings.TrimPrefix(lrps[0].Name, joinPortPrefix), nil
+}
+
+// vmNexthop returns the nexthop of the VM n/s traffic, the policies and
+// routes are identified by the network and the owner like the routing does,
+// the ones created before they had the network by the VM address
+func vmNexthop(nbcli ovsclient.Client, network string, owner map[string]string, vmAddress string) (string, error) {
+	isVM := func(externalIDs map[string]string, address string) bool {
+		itemNetwork, ok := externalIDs[networkExternalIDKey]
+		if !ok {
+			return address == vmAddress
+		}
+		return itemNetwork == network && isVMOwner(externalIDs, owner)
+	}
+	policies, err := libovsdbops.FindLogicalRouterPoliciesWithPredicate(nbcli, func(item *nbdb.LogicalRouterPolicy) bool {
+		return item.Action == nbdb.LogicalRouterPolicyActionReroute && len(item.Nexthops) > 0 &&
+			isVM(item.ExternalIDs, strings.TrimPrefix(item.Match, "ip4.src == "))
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed looking for %s reroute policy: %v", vmAddress, err)
+	}
+	if len(policies) > 0 {
+		return policies[0].Nexthops[0], nil
+	}
+	routes, err := libovsdbops.FindLogicalRouterStaticRoutesWithPredicate(nbcli, func(item *nbdb.LogicalRouterStaticRoute) bool {
+		return item.Policy != nil && *item.Policy == nbdb.LogicalRouterStaticRoutePolicySrcIP &&
+			!strings.Contains(item.IPPrefix, "/") && isVM(item.ExternalIDs, item.IPPrefix)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed looking for %s source route: %v", vmAddress, err)
+	}
+	if len(routes) > 0 {
+		return routes[0].Nexthop, nil
+	}
+	return "", fmt.Errorf("missing reroute policy or source route for %s", vmAddress)
+}
+
+// floatingIPReconciler implements the FloatingIPs at the gateway router the
+// VMI is rerouted to
+type floatingIPReconciler struct {
+	k8scli k8sclient.Client
+	nbcli  ovsclient.Client
+}
+
+func (r *floatingIPReconciler) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	key := floatingIPKey(request.Namespace, request.Name)
+	fip := &ovnkubevirtv1alpha1.FloatingIP{}
+	if err := r.k8scli.Get(ctx, request.NamespacedName, fip); err != nil {
+		if apierrors.IsNotFound(err) {
+			return reconcile.Result{}, deleteFloatingIP(r.nbcli, key)
+		}
+		return reconcile.Result{}, err
+	}
+
+	status, err := r.ensure(ctx, fip)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if status.Node == "" {
+		// The VMI is not running at the tenant network or the floating ip
+		// cannot be implemented
+		if err := deleteFloatingIP(r.nbcli, key); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	if fip.Status != *status {
+		fip.Status = *status
+		if err := r.k8scli.Status().Update(ctx, fip); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+	return reconcile.Result{}, nil
+}
+
+func (r *floatingIPReconciler) ensure(ctx context.Context, fip *ovnkubevirtv1alpha1.FloatingIP) (*ovnkubevirtv1alpha1.FloatingIPStatus, error) {
+	vmi := &kubevirtv1.VirtualMachineInstance{}
+	if err := r.k8scli.Get(ctx, types.NamespacedName{Namespace: fip.Namespace, Name: fip.Spec.VMI}, vmi); err != nil {
+		if apierrors.IsNotFound(err) {
+			return &ovnkubevirtv1alpha1.FloatingIPStatus{}, nil
+		}
+		return nil, err
+	}
+
+	ls, err := findSwitch(r.nbcli, fip.Spec.Network)
+	if err != nil {
+		return nil, err
+	}
+	if ls == nil {
+		return &ovnkubevirtv1alpha1.FloatingIPStatus{}, nil
+	}
+	// The gateway routers cannot reach the VMs behind a dedicated router
+	dedicated, err := isDedicatedRouterNetwork(r.nbcli, fip.Spec.Network)
+	if err != nil {
+		return nil, err
+	}
+	if dedicated {
+		return &ovnkubevirtv1alpha1.FloatingIPStatus{Error: "floating ips are not supported with a dedicated router"}, nil
+	}
+	// The floating ip is implemented for the first VMI interface attached
+	// to the network
+	lsps, err := vmiSwitchPorts(r.nbcli, ls, vmi)
+	if err != nil {
+		return nil, err
+	}
+	if len(lsps) == 0 {
+		return &ovnkubevirtv1alpha1.FloatingIPStatus{}, nil
+	}
+	vmAddress, err := logicalSwitchPortAddress(r.nbcli, &lsps[0])
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := gatewayNodeForPort(r.nbcli, fip.Spec.Network, vmi, &lsps[0], vmAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ensureFloatingIP(r.nbcli, fip, vmAddress, node); err != nil {
+		return nil, err
+	}
+	return &ovnkubevirtv1alpha1.FloatingIPStatus{LogicalIP: vmAddress, Node: node}, nil
+}
+
+// vmiToFloatingIPs reconciles the VMI floating ips after it's started or
+// migrated
+func (r *floatingIPReconciler) vmiToFloatingIPs(obj k8sclient.Object) []reconcile.Request {
+	vmi, ok := obj.(*kubevirtv1.VirtualMachineInstance)
+	if !ok {
+		return nil
+	}
+	fips, err := vmiFloatingIPs(context.Background(), r.k8scli, vmi)
+	if err != nil {
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, fip := range fips {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: fip.Namespace, Name: fip.Name}})
+	}
+	return requests
+}
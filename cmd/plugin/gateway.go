@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	ovsclient "github.com/ovn-org/libovsdb/client"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/libovsdbops"
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+	ovnktypes "github.com/ovn-org/ovn-kubernetes/go-controller/pkg/types"
+)
+
+func gatewayRouterName(network, node string) string {
+	return ovnktypes.GWRouterPrefix + network + "_" + node
+}
+
+func gatewayExternalSwitchName(network, node string) string {
+	return ovnktypes.ExternalSwitchPrefix + network + "_" + node
+}
+
+// newGateway builds a dedicated gateway router for each configured node,
+// connected to the tenant dedicated router with a /30 of the join subnet
+func newGateway(ctx *CmdContext) (*Gateway, error) {
+	if len(ctx.conf.Gateway.Nodes) == 0 {
+		return nil, fmt.Errorf("missing dedicated gateway nodes")
+	}
+
+	chassis, err := libovsdbops.ListChassis(ctx.sbcli)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing chassis: %v", err)
+	}
+	chassisByHostname := map[string]string{}
+	for _, c := range chassis {
+		chassisByHostname[c.Hostname] = c.Name
+	}
+
+	blocks, err := gatewayJoinBlocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Gateway{routers: map[string]*GatewayRouter{}}
+	for _, node := range ctx.conf.Gateway.Nodes {
+		chassisName, ok := chassisByHostname[node.Name]
+		if !ok {
+			return nil, fmt.Errorf("missing chassis for dedicated gateway node %s", node.Name)
+		}
+		gr := &GatewayRouter{
+			lr: &nbdb.LogicalRouter{
+				Name:    gatewayRouterName(ctx.conf.Name, node.Name),
+				Enabled: &enabled,
+				Options: map[string]string{
+					"chassis": chassisName,
+				},
+				ExternalIDs: map[string]string{
+					networkExternalIDKey: ctx.conf.Name,
+					nodeExternalIDKey:    node.Name,
+				},
+			},
+		}
+		if err := gr.setNodePort(ctx, node); err != nil {
+			return nil, err
+		}
+		if err := gr.setJoinPort(ctx, blocks[node.Name], node.Name); err != nil {
+			return nil, err
+		}
+		gr.joinPeer, err = ctx.joinRouter.addGatewayPort(ctx, blocks[node.Name], node.Name, gr.lr.Name)
+		if err != nil {
+			return nil, err
+		}
+		joinIP, _, err := net.ParseCIDR(gr.joinPort.Networks[0])
+		if err != nil {
+			return nil, err
+		}
+		ctx.joinRouter.gwAddresses[node.Name] = joinIP.String()
+		g.routers[node.Name] = gr
+	}
+	return g, nil
+}
+
+// node returns the gateway node for the VMs running at hostname, the node
+// itself if it has a dedicated gateway router or the first configured one
+func (g *Gateway) node(ctx *CmdContext, hostname string) string {
+	if _, ok := g.routers[hostname]; ok {
+		return hostname
+	}
+	return ctx.conf.Gateway.Nodes[0].Name
+}
+
+func (g *Gateway) ensure(ctx *CmdContext, t *nbTxn) error {
+	for node, gr := range g.routers {
+		if err := gr.ensure(ctx, t, node); err != nil {
+			return fmt.Errorf("failed ensuring dedicated gateway router %s: %v", gr.lr.Name, err)
+		}
+	}
+	return g.deleteStaleRouters(ctx, t)
+}
+
+// deleteStaleRouters removes the dedicated gateway routers of the nodes no
+// longer configured with their external switch and the dedicated router port
+// connected to them, the rest of their rows are garbage collected
+func (g *Gateway) deleteStaleRouters(ctx *CmdContext, t *nbTxn) error {
+	stale, err := libovsdbops.FindLogicalRoutersWithPredicate(ctx.nbcli, func(item *nbdb.LogicalRouter) bool {
+		node := item.ExternalIDs[nodeExternalIDKey]
+		_, ok := g.routers[node]
+		return !ok && item.ExternalIDs[networkExternalIDKey] == ctx.conf.Name && item.Name == gatewayRouterName(ctx.conf.Name, node)
+	})
+	if err != nil {
+		return fmt.Errorf("failed looking for stale dedicated gateway routers: %v", err)
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	lr, err := t.router(ctx.joinRouter.lr.Name)
+	if err != nil {
+		return err
+	}
+	for _, gwRouter := range stale {
+		node := gwRouter.ExternalIDs[nodeExternalIDKey]
+		if err := t.delete(gwRouter); err != nil {
+			return fmt.Errorf("failed deleting stale dedicated gateway router %s: %v", gwRouter.Name, err)
+		}
+		extSwitch, err := findSwitch(ctx.nbcli, gatewayExternalSwitchName(ctx.conf.Name, node))
+		if err != nil {
+			return err
+		}
+		if extSwitch != nil {
+			if err := t.delete(extSwitch); err != nil {
+				return fmt.Errorf("failed deleting stale external switch %s: %v", extSwitch.Name, err)
+			}
+		}
+		peer, err := libovsdbops.GetLogicalRouterPort(ctx.nbcli, &nbdb.LogicalRouterPort{Name: joinToGwPortName(gwRouter.Name)})
+		if errors.Is(err, ovsclient.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed getting router port %s: %v", joinToGwPortName(gwRouter.Name), err)
+		}
+		if err := t.remove(lr, &lr.Ports, peer.UUID); err != nil {
+			return fmt.Errorf("failed removing router port %s: %v", peer.Name, err)
+		}
+	}
+	return nil
+}
+
+// ensure creates the gateway router with its external switch, routes the
+// tenant subnet to the dedicated router and masquerades it with the gateway
+// router external address
+func (g *GatewayRouter) ensure(ctx *CmdContext, t *nbTxn, node string) error {
+	if err := t.ensureRouter(g.lr); err != nil {
+		return err
+	}
+	for _, lrp := range []*nbdb.LogicalRouterPort{g.gwPort, g.joinPort} {
+		if err := t.ensureRouterPort(g.lr.Name, lrp); err != nil {
+			return err
+		}
+	}
+
+	externalIDs := map[string]string{
+		networkExternalIDKey: ctx.conf.Name,
+		nodeExternalIDKey:    node,
+	}
+
+	extSwitch := &nbdb.LogicalSwitch{
+		Name:        gatewayExternalSwitchName(ctx.conf.Name, node),
+		ExternalIDs: externalIDs,
+	}
+	lsps := []*nbdb.LogicalSwitchPort{
+		{
+			Name:      ovnktypes.EXTSwitchToGWRouterPrefix + g.lr.Name,
+			Type:      "router",
+			Addresses: []string{"router"},
+			Enabled:   &enabled,
+			Options: map[string]string{
+				"router-port": g.gwPort.Name,
+			},
+			ExternalIDs: externalIDs,
+		},
+		{
+			Name:      ctx.conf.Gateway.physicalNetwork() + "_" + extSwitch.Name,
+			Type:      "localnet",
+			Addresses: []string{"unknown"},
+			Enabled:   &enabled,
+			Options: map[string]string{
+				"network_name": ctx.conf.Gateway.physicalNetwork(),
+			},
+			ExternalIDs: externalIDs,
+		},
+	}
+	if err := t.ensureSwitch(extSwitch); err != nil {
+		return err
+	}
+	for _, lsp := range lsps {
+		if err := t.ensureSwitchPort(extSwitch.Name, lsp); err != nil {
+			return err
+		}
+	}
+
+	joinPeerIP, _, err := net.ParseCIDR(g.joinPeer.Networks[0])
+	if err != nil {
+		return err
+	}
+	routes := []nbdb.LogicalRouterStaticRoute{
+		{
+			IPPrefix:    ctx.conf.Subnet,
+			Nexthop:     joinPeerIP.String(),
+			ExternalIDs: externalIDs,
+		},
+	}
+	if ctx.conf.Gateway.NextHop != "" {
+		routes = append(routes, nbdb.LogicalRouterStaticRoute{
+			IPPrefix:    "0.0.0.0/0",
+			Nexthop:     ctx.conf.Gateway.NextHop,
+			OutputPort:  &g.gwPort.Name,
+			ExternalIDs: externalIDs,
+		})
+	}
+	for i := range routes {
+		route := &routes[i]
+		predicate := func(item *nbdb.LogicalRouterStaticRoute) bool {
+			return item.ExternalIDs[networkExternalIDKey] == ctx.conf.Name && item.IPPrefix == route.IPPrefix
+		}
+		if err := t.ensureRouterStaticRoute(g.lr.Name, route, predicate); err != nil {
+			return err
+		}
+	}
+
+	externalIP, _, err := net.ParseCIDR(g.gwPort.Networks[0])
+	if err != nil {
+		return err
+	}
+	masqueradeNAT := &nbdb.NAT{
+		ExternalIP: externalIP.String(),
+		LogicalIP:  ctx.conf.Subnet,
+		Type:       nbdb.NATTypeSNAT,
+		Options: map[string]string{
+			"stateless": "false",
+		},
+		ExternalIDs: externalIDs,
+	}
+	return t.ensureRouterNAT(g.lr.Name, masqueradeNAT, func(item *nbdb.NAT) bool {
+		return item.Type == masqueradeNAT.Type && item.ExternalIDs[networkExternalIDKey] == ctx.conf.Name
+	})
+}
+
+// gatewayJoinBlocks returns the /30 subnet of the join subnet, by index, of
+// each configured node. The nodes keep the one of their dedicated router
+// port, so they are not renumbered if the node list changes, the rest get a
+// free one starting at the node name hash.
+func gatewayJoinBlocks(ctx *CmdContext) (map[string]uint32, error) {
+	ipNet, blocks, err := gatewayJoinSubnet(ctx.conf.Gateway.joinSubnet())
+	if err != nil {
+		return nil, err
+	}
+	base := binary.BigEndian.Uint32(ipNet.IP.To4())
+
+	nodeBlocks := map[string]uint32{}
+	used := map[uint32]bool{}
+	for _, node := range ctx.conf.Gateway.Nodes {
+		lrp, err := libovsdbops.GetLogicalRouterPort(ctx.nbcli, &nbdb.LogicalRouterPort{Name: joinToGwPortName(gatewayRouterName(ctx.conf.Name, node.Name))})
+		if errors.Is(err, ovsclient.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed getting node %s dedicated router port: %v", node.Name, err)
+		}
+		if len(lrp.Networks) == 0 {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(lrp.Networks[0])
+		if err != nil || ip.To4() == nil || !ipNet.Contains(ip) {
+			// The join subnet has changed
+			continue
+		}
+		offset := binary.BigEndian.Uint32(ip.To4()) - base
+		if offset%4 != 1 || used[offset/4] {
+			continue
+		}
+		nodeBlocks[node.Name] = offset / 4
+		used[offset/4] = true
+	}
+
+	for _, node := range ctx.conf.Gateway.Nodes {
+		if _, ok := nodeBlocks[node.Name]; ok {
+			continue
+		}
+		block, ok := freeSlot(blocks, node.Name, func(block uint32) bool { return used[block] })
+		if !ok {
+			return nil, fmt.Errorf("gateway join subnet %s is too small for %d gateway routers", ipNet, len(ctx.conf.Gateway.Nodes))
+		}
+		nodeBlocks[node.Name] = block
+		used[block] = true
+	}
+	return nodeBlocks, nil
+}
+
+// gatewayJoinSubnet returns the join subnet and its number of /30 subnets
+func gatewayJoinSubnet(subnet string) (*net.IPNet, uint32, error) {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid gateway join subnet %q: %v", subnet, err)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits != 32 || ones > 30 {
+		return nil, 0, fmt.Errorf("gateway join subnet %s has to be an IPv4 subnet of at least /30", subnet)
+	}
+	return ipNet, uint32(1) << (30 - ones), nil
+}
+
+// gatewayJoinAddresses returns the dedicated router and gateway router
+// addresses of the i-th /30 subnet of the join subnet
+func gatewayJoinAddresses(subnet string, i uint32) (string, string, error) {
+	ipNet, blocks, err := gatewayJoinSubnet(subnet)
+	if err != nil {
+		return "", "", err
+	}
+	if i >= blocks {
+		return "", "", fmt.Errorf("gateway join subnet %s has no /30 subnet %d", subnet, i)
+	}
+	base := binary.BigEndian.Uint32(ipNet.IP.To4()) + 4*i
+	address := func(offset uint32) string {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+offset)
+		return fmt.Sprintf("%s/30", ip)
+	}
+	return address(1), address(2), nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+
+	ovsclient "github.com/ovn-org/libovsdb/client"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/libovsdbops"
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+)
+
+// lspAddress returns the IP of the switch port, the static one or the one
+// dynamically assigned by ovn-northd
+func lspAddress(lsp *nbdb.LogicalSwitchPort) string {
+	for _, address := range lsp.Addresses {
+		fields := strings.Fields(address)
+		if len(fields) > 1 && net.ParseIP(fields[1]) != nil {
+			return fields[1]
+		}
+	}
+	if lsp.DynamicAddresses != nil {
+		fields := strings.Fields(*lsp.DynamicAddresses)
+		if len(fields) > 1 && net.ParseIP(fields[1]) != nil {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// vmAddress returns the address of the VM switch port if it already has one,
+// otherwise it allocates a free address of the tenant subnet starting at the
+// port name hash. The address is allocated by the plugin instead of
+// ovn-northd so the VM policies and NATs can be configured at the same
+// transaction as the port. The ADD transaction waits for the switch ports to
+// be the ones read here, so concurrent ADDs at other nodes cannot commit
+// the same address, the one failing is retried by the runtime.
+func vmAddress(ctx *CmdContext, ls *nbdb.LogicalSwitch, portName string) (string, error) {
+	lsp, err := libovsdbops.GetLogicalSwitchPort(ctx.nbcli, &nbdb.LogicalSwitchPort{Name: portName})
+	if err != nil && !errors.Is(err, ovsclient.ErrNotFound) {
+		return "", fmt.Errorf("failed getting switch port %s: %v", portName, err)
+	}
+	if lsp != nil {
+		if address := lspAddress(lsp); address != "" {
+			return address, nil
+		}
+	}
+
+	_, ipNet, err := net.ParseCIDR(ctx.conf.Subnet)
+	if err != nil {
+		return "", fmt.Errorf("invalid tenant subnet %q: %v", ctx.conf.Subnet, err)
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits != 32 || bits-ones < 2 {
+		return "", fmt.Errorf("tenant subnet %s has to be an IPv4 subnet with at least two addresses", ctx.conf.Subnet)
+	}
+
+	used := map[uint32]bool{}
+	use := func(address string) {
+		if ip := net.ParseIP(address).To4(); ip != nil {
+			used[binary.BigEndian.Uint32(ip)] = true
+		}
+	}
+	use(ctx.conf.Router)
+	if err := excludedAddresses(ctx.conf.ExcludeIps, use); err != nil {
+		return "", err
+	}
+	// The switch is nil if the network has none yet
+	if ls != nil && ls.UUID != "" {
+		lsps := []nbdb.LogicalSwitchPort{}
+		if err := ctx.nbcli.WhereCache(func(item *nbdb.LogicalSwitchPort) bool {
+			return containsString(ls.Ports, item.UUID)
+		}).List(context.Background(), &lsps); err != nil {
+			return "", fmt.Errorf("failed listing switch %s ports: %v", ls.Name, err)
+		}
+		for i := range lsps {
+			use(lspAddress(&lsps[i]))
+		}
+	}
+
+	// Skip the network and broadcast addresses
+	first := binary.BigEndian.Uint32(ipNet.IP.To4()) + 1
+	hosts := uint32(1)<<(bits-ones) - 2
+	slot, ok := freeSlot(hosts, portName, func(slot uint32) bool { return used[first+slot] })
+	if !ok {
+		return "", fmt.Errorf("tenant subnet %s is exhausted", ctx.conf.Subnet)
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, first+slot)
+	return ip.String(), nil
+}
+
+// freeSlot returns the first slot below size not in use, starting at the key
+// hash and wrapping around, so concurrent allocations for different keys are
+// unlikely to collide. It returns false if all of them are in use.
+func freeSlot(size uint32, key string, inUse func(uint32) bool) (uint32, bool) {
+	if size == 0 {
+		return 0, false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	start := h.Sum32() % size
+	for i := uint32(0); i < size; i++ {
+		slot := (start + i) % size
+		if !inUse(slot) {
+			return slot, true
+		}
+	}
+	return 0, false
+}
+
+// excludedAddresses calls use with each address of the OVN exclude_ips
+// format, a list of addresses and address ranges like "10.0.0.2..10.0.0.9"
+func excludedAddresses(excludeIPs string, use func(string)) error {
+	for _, item := range strings.Fields(excludeIPs) {
+		bounds := strings.SplitN(item, "..", 2)
+		first := net.ParseIP(bounds[0]).To4()
+		if first == nil {
+			return fmt.Errorf("invalid exclude ip %q", item)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last = net.ParseIP(bounds[1]).To4()
+			if last == nil {
+				return fmt.Errorf("invalid exclude ip %q", item)
+			}
+		}
+		for i := binary.BigEndian.Uint32(first); i <= binary.BigEndian.Uint32(last); i++ {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, i)
+			use(ip.String())
+			if i == ^uint32(0) {
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	ovsclient "github.com/ovn-org/libovsdb/client"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+	libovsdbtest "github.com/ovn-org/ovn-kubernetes/go-controller/pkg/testing/libovsdb"
+)
+
+func TestExcludedAddresses(t *testing.T) {
+	tests := []struct {
+		excludeIPs string
+		want       []string
+		wantErr    bool
+	}{
+		{excludeIPs: ""},
+		{excludeIPs: "10.0.0.2", want: []string{"10.0.0.2"}},
+		{excludeIPs: "10.0.0.2 10.0.0.7", want: []string{"10.0.0.2", "10.0.0.7"}},
+		{excludeIPs: "10.0.0.254..10.0.1.1", want: []string{"10.0.0.254", "10.0.0.255", "10.0.1.0", "10.0.1.1"}},
+		{excludeIPs: "255.255.255.254..255.255.255.255", want: []string{"255.255.255.254", "255.255.255.255"}},
+		{excludeIPs: "10.0.0.5..10.0.0.4"},
+		{excludeIPs: "foo", wantErr: true},
+		{excludeIPs: "10.0.0.2..foo", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.excludeIPs, func(t *testing.T) {
+			var got []string
+			err := excludedAddresses(tt.excludeIPs, func(address string) { got = append(got, address) })
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("excludedAddresses(%q) = %v, want %v", tt.excludeIPs, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFreeSlot(t *testing.T) {
+	const size = 8
+	start, ok := freeSlot(size, "key", func(uint32) bool { return false })
+	if !ok || start >= size {
+		t.Fatalf("freeSlot() = %d, %t, want a slot below %d", start, ok, size)
+	}
+	if slot, _ := freeSlot(size, "key", func(uint32) bool { return false }); slot != start {
+		t.Errorf("freeSlot() is not stable, got %d and %d", start, slot)
+	}
+
+	// The used slots are skipped wrapping around
+	used := map[uint32]bool{start: true, (start + 1) % size: true}
+	if slot, ok := freeSlot(size, "key", func(slot uint32) bool { return used[slot] }); !ok || slot != (start+2)%size {
+		t.Errorf("freeSlot() = %d, %t, want %d", slot, ok, (start+2)%size)
+	}
+
+	if slot, ok := freeSlot(size, "key", func(uint32) bool { return true }); ok {
+		t.Errorf("freeSlot() = %d with all the slots in use", slot)
+	}
+	if slot, ok := freeSlot(0, "key", func(uint32) bool { return false }); ok {
+		t.Errorf("freeSlot() = %d without slots", slot)
+	}
+}
+
+// newIPAMTest returns the NB client with the tenant switch and a port per
+// address
+func newIPAMTest(t *testing.T, addresses ...string) (ovsclient.Client, *nbdb.LogicalSwitch) {
+	ls := &nbdb.LogicalSwitch{UUID: "ls-uuid", Name: "net1"}
+	data := []libovsdbtest.TestData{}
+	for i, address := range addresses {
+		lsp := &nbdb.LogicalSwitchPort{
+			UUID:      fmt.Sprintf("lsp%d-uuid", i),
+			Name:      fmt.Sprintf("lsp%d", i),
+			Addresses: []string{ipToMAC(net.ParseIP(address)) + " " + address},
+		}
+		ls.Ports = append(ls.Ports, lsp.UUID)
+		data = append(data, lsp)
+	}
+	nbcli, cleanup, err := libovsdbtest.NewNBTestHarness(libovsdbtest.TestSetup{NBData: append(data, ls)}, nil)
+	if err != nil {
+		t.Fatalf("failed creating NB test harness: %v", err)
+	}
+	t.Cleanup(cleanup.Cleanup)
+	// The harness replaces the UUIDs
+	ls, err = findSwitch(nbcli, ls.Name)
+	if err != nil || ls == nil {
+		t.Fatalf("failed getting switch: %v", err)
+	}
+	return nbcli, ls
+}
+
+func TestVMAddress(t *testing.T) {
+	conf := &PluginConf{
+		Subnet:     "192.168.10.0/29",
+		Router:     "192.168.10.1",
+		ExcludeIps: "192.168.10.6",
+	}
+	conf.Name = "net1"
+
+	t.Run("keeps the port address", func(t *testing.T) {
+		nbcli, ls := newIPAMTest(t, "192.168.10.4")
+		got, err := vmAddress(&CmdContext{nbcli: nbcli, conf: conf}, ls, "lsp0")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != "192.168.10.4" {
+			t.Errorf("got %s, want the port address 192.168.10.4", got)
+		}
+	})
+
+	t.Run("skips the address of other port with the same hash", func(t *testing.T) {
+		nbcli, ls := newIPAMTest(t)
+		ctx := &CmdContext{nbcli: nbcli, conf: conf}
+		first, err := vmAddress(ctx, ls, "vm")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		nbcli, ls = newIPAMTest(t, first)
+		ctx.nbcli = nbcli
+		second, err := vmAddress(ctx, ls, "vm")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if second == first {
+			t.Errorf("got %s, already used by other port", second)
+		}
+	})
+
+	t.Run("allocates every free address until exhausted", func(t *testing.T) {
+		// 192.168.10.0/29 has 6 hosts, minus the router and the excluded one
+		allocated := []string{}
+		for i := 0; i < 4; i++ {
+			nbcli, ls := newIPAMTest(t, allocated...)
+			address, err := vmAddress(&CmdContext{nbcli: nbcli, conf: conf}, ls, fmt.Sprintf("vm%d", i))
+			if err != nil {
+				t.Fatalf("unexpected error allocating address %d: %v", i, err)
+			}
+			if address == conf.Router || address == conf.ExcludeIps {
+				t.Fatalf("allocated reserved address %s", address)
+			}
+			if containsString(allocated, address) {
+				t.Fatalf("allocated address %s twice", address)
+			}
+			allocated = append(allocated, address)
+		}
+		nbcli, ls := newIPAMTest(t, allocated...)
+		if address, err := vmAddress(&CmdContext{nbcli: nbcli, conf: conf}, ls, "vm4"); err == nil {
+			t.Errorf("got %s from an exhausted subnet", address)
+		}
+	})
+
+	t.Run("new switch", func(t *testing.T) {
+		nbcli, _ := newIPAMTest(t)
+		address, err := vmAddress(&CmdContext{nbcli: nbcli, conf: conf}, nil, "vm")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, subnet, _ := net.ParseCIDR(conf.Subnet); !subnet.Contains(net.ParseIP(address)) {
+			t.Errorf("got %s out of the subnet", address)
+		}
+	})
+
+	t.Run("invalid subnet", func(t *testing.T) {
+		nbcli, ls := newIPAMTest(t)
+		for _, subnet := range []string{"foo", "192.168.10.0/31", "fd00::/64"} {
+			invalid := *conf
+			invalid.Subnet = subnet
+			if _, err := vmAddress(&CmdContext{nbcli: nbcli, conf: &invalid}, ls, "vm"); err == nil {
+				t.Errorf("expected error for subnet %s", subnet)
+			}
+		}
+	})
+}
+
+func TestConcurrentAddressAllocation(t *testing.T) {
+	commit := func(t *testing.T, nbcli ovsclient.Client, wait func(*nbTxn) error) error {
+		txn := newNBTxn(nbcli)
+		if err := wait(txn); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		lsp := &nbdb.LogicalSwitchPort{Name: "vm"}
+		if err := txn.create(lsp, &lsp.UUID); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return txn.commit()
+	}
+
+	t.Run("switch ports changed", func(t *testing.T) {
+		nbcli, ls := newIPAMTest(t, "192.168.10.2")
+		// The test server does not compare empty sets, so the stale ports are
+		// a different one
+		stale := *ls
+		stale.Ports = []string{"0c2d3f5c-9a0f-4b4e-8a8a-1b2c3d4e5f60"}
+		if err := commit(t, nbcli, func(txn *nbTxn) error { return txn.waitSwitchPorts(&stale) }); err == nil {
+			t.Errorf("expected the transaction to fail")
+		}
+		if err := commit(t, nbcli, func(txn *nbTxn) error { return txn.waitSwitchPorts(ls) }); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("switch created", func(t *testing.T) {
+		nbcli, _ := newIPAMTest(t)
+		if err := commit(t, nbcli, func(txn *nbTxn) error { txn.waitNoSwitch("net1"); return nil }); err == nil {
+			t.Errorf("expected the transaction to fail")
+		}
+		if err := commit(t, nbcli, func(txn *nbTxn) error { txn.waitNoSwitch("net2"); return nil }); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+)
+
+// isolationPolicyPriority is higher than the policies that keep the e/w
+// traffic and reroute the n/s traffic
+const isolationPolicyPriority = 3
+
+// isolationExternalIDKey is set at the policy dropping the isolated tenant
+// network traffic to the infra cluster
+const isolationExternalIDKey = "ovn-kubevirt/isolation"
+
+// ensureIsolationPolicy drops the traffic from an isolated tenant network to
+// the infra cluster pods and services, except the allowed destinations, and
+// removes the policy if the network is not isolated.
+func (j *JoinRouter) ensureIsolationPolicy(ctx *CmdContext, t *nbTxn) error {
+	predicate := func(item *nbdb.LogicalRouterPolicy) bool {
+		return item.ExternalIDs[networkExternalIDKey] == ctx.conf.Name && item.ExternalIDs[isolationExternalIDKey] != ""
+	}
+
+	if !ctx.conf.Isolation {
+		if err := t.deleteRouterPolicies(j.lr.Name, predicate); err != nil {
+			return fmt.Errorf("failed removing tenant network isolation policy: %v", err)
+		}
+		return nil
+	}
+
+	allowRules := ctx.conf.IsolationAllow
+	if allowRules == nil {
+		dnsServer, err := kubeDNSNameServer(ctx)
+		if err != nil {
+			return err
+		}
+		allowRules = []IsolationAllowRule{
+			{CIDR: dnsServer, Protocol: "udp", Port: 53},
+			{CIDR: dnsServer, Protocol: "tcp", Port: 53},
+		}
+	}
+
+	allowMatch, err := isolationAllowMatch(allowRules)
+	if err != nil {
+		return err
+	}
+
+	infraSubnets := append(append([]string{}, ctx.conf.infraSubnets()...), ctx.conf.serviceSubnets()...)
+	match := fmt.Sprintf("ip4.src == %s && ip4.dst == { %s }", ctx.conf.Subnet, strings.Join(infraSubnets, ", "))
+	if allowMatch != "" {
+		match = fmt.Sprintf("%s && !(%s)", match, allowMatch)
+	}
+
+	policy := nbdb.LogicalRouterPolicy{
+		Match:    match,
+		Action:   nbdb.LogicalRouterPolicyActionDrop,
+		Priority: isolationPolicyPriority,
+		ExternalIDs: map[string]string{
+			networkExternalIDKey:   ctx.conf.Name,
+			isolationExternalIDKey: "true",
+		},
+	}
+
+	if err := t.ensureRouterPolicy(j.lr.Name, &policy, predicate); err != nil {
+		return fmt.Errorf("failed ensuring tenant network isolation policy: %v", err)
+	}
+	return nil
+}
+
+func isolationAllowMatch(rules []IsolationAllowRule) (string, error) {
+	matches := []string{}
+	for _, rule := range rules {
+		if _, _, err := net.ParseCIDR(rule.CIDR); err != nil && net.ParseIP(rule.CIDR) == nil {
+			return "", fmt.Errorf("invalid isolation allow cidr %q", rule.CIDR)
+		}
+		match := fmt.Sprintf("ip4.dst == %s", rule.CIDR)
+		if rule.Protocol != "" {
+			protocol := strings.ToLower(rule.Protocol)
+			if protocol != "tcp" && protocol != "udp" && protocol != "sctp" {
+				return "", fmt.Errorf("invalid isolation allow protocol %q", rule.Protocol)
+			}
+			if rule.Port > 0 {
+				match = fmt.Sprintf("%s && %s.dst == %d", match, protocol, rule.Port)
+			} else {
+				match = fmt.Sprintf("%s && %s", match, protocol)
+			}
+		}
+		matches = append(matches, fmt.Sprintf("(%s)", match))
+	}
+	return strings.Join(matches, " || "), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+)
+
+const (
+	// layer3Topology connects the tenant switch to a router that sends the
+	// VMs n/s traffic to the gateway routers
+	layer3Topology = "layer3"
+	// layer2Topology only creates the tenant switch and its ports, the
+	// tenant routes the network with its own router VM
+	layer2Topology = "layer2"
+	// topologyExternalIDKey is set at the tenant switch of the layer2
+	// networks
+	topologyExternalIDKey = "ovn-kubevirt/topology"
+)
+
+// checkLayer2Conf returns an error if the layer2 network has options that
+// need a router
+func checkLayer2Conf(conf *PluginConf) error {
+	switch {
+	case conf.dedicatedRouter():
+		return fmt.Errorf("dedicated router, isolation and gateway cannot be configured with layer2 topology")
+	case conf.EgressIP != "":
+		return fmt.Errorf("egress ip cannot be configured with layer2 topology")
+	case conf.Masquerade != nil:
+		return fmt.Errorf("masquerade cannot be configured with layer2 topology")
+	case conf.Routing != "":
+		return fmt.Errorf("routing cannot be configured with layer2 topology")
+	}
+	return nil
+}
+
+// layer2DHCPOptions returns the DHCP options of the layer2 network, the
+// tenant router VM is the default gateway. It returns nil if the network
+// has no router, then DHCP is not served. The infra DNS is not reachable
+// from the network so it's not offered.
+func layer2DHCPOptions(ctx *CmdContext) (*nbdb.DHCPOptions, error) {
+	if ctx.conf.Router == "" {
+		return nil, nil
+	}
+	router := net.ParseIP(ctx.conf.Router)
+	if router == nil || router.To4() == nil {
+		return nil, fmt.Errorf("invalid router %q", ctx.conf.Router)
+	}
+	return &nbdb.DHCPOptions{
+		Cidr: ctx.conf.Subnet,
+		Options: map[string]string{
+			"lease_time": ctx.conf.LeaseTime,
+			"router":     ctx.conf.Router,
+			"server_id":  ctx.conf.Router,
+			"server_mac": ipToMAC(router),
+		},
+	}, nil
+}
+
+// isLayer2Switch returns true for the tenant switches of layer2 networks
+func isLayer2Switch(ls *nbdb.LogicalSwitch) bool {
+	return ls.ExternalIDs[topologyExternalIDKey] == layer2Topology
+}
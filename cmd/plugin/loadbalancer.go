@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/ovn-org/libovsdb/ovsdb"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	ovsclient "github.com/ovn-org/libovsdb/client"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/libovsdbops"
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+	ovnktypes "github.com/ovn-org/ovn-kubernetes/go-controller/pkg/types"
+
+	k8sclient "sigs.k8s.io/controller-runtime/pkg/client"
+
+	ovnkubevirtv1alpha1 "github.com/qinqon/ovn-kubevirt/api/v1alpha1"
+)
+
+// tenantLoadBalancerReconciler implements the TenantLoadBalancers with one
+// OVN load balancer per protocol
+type tenantLoadBalancerReconciler struct {
+	k8scli k8sclient.Client
+	nbcli  ovsclient.Client
+}
+
+func (r *tenantLoadBalancerReconciler) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	key := tenantLoadBalancerKey(request.Namespace, request.Name)
+	tlb := &ovnkubevirtv1alpha1.TenantLoadBalancer{}
+	if err := r.k8scli.Get(ctx, request.NamespacedName, tlb); err != nil {
+		if apierrors.IsNotFound(err) {
+			return reconcile.Result{}, deleteTenantLoadBalancer(r.nbcli, key)
+		}
+		return reconcile.Result{}, err
+	}
+
+	ls, err := libovsdbops.GetLogicalSwitch(r.nbcli, &nbdb.LogicalSwitch{Name: tlb.Spec.Network})
+	if err != nil {
+		if errors.Is(err, ovsclient.ErrNotFound) {
+			// No VMI has been attached to the tenant network yet
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, fmt.Errorf("failed getting tenant logical switch %s: %v", tlb.Spec.Network, err)
+	}
+
+	backends, err := selectNetworkPorts(ctx, r.k8scli, r.nbcli, ls, tlb.Namespace, &tlb.Spec.Selector)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	nodeList := &corev1.NodeList{}
+	if err := r.k8scli.List(ctx, nodeList); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if err := ensureTenantLoadBalancer(r.nbcli, tlb, ls, backends, nodeList.Items); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	status := ovnkubevirtv1alpha1.TenantLoadBalancerStatus{}
+	for _, backend := range backends {
+		status.Backends = append(status.Backends, backend.address)
+	}
+	if !reflect.DeepEqual(tlb.Status, status) {
+		tlb.Status = status
+		if err := r.k8scli.Status().Update(ctx, tlb); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+	return reconcile.Result{}, nil
+}
+
+// vmiToTenantLoadBalancers reconciles the load balancers at the VMI
+// namespace, the VMI labels may not match anymore so all of them are
+// reconciled
+func (r *tenantLoadBalancerReconciler) vmiToTenantLoadBalancers(obj k8sclient.Object) []reconcile.Request {
+	tlbList := &ovnkubevirtv1alpha1.TenantLoadBalancerList{}
+	if err := r.k8scli.List(context.Background(), tlbList, k8sclient.InNamespace(obj.GetNamespace())); err != nil {
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, tlb := range tlbList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: tlb.Namespace, Name: tlb.Name}})
+	}
+	return requests
+}
+
+func tenantLoadBalancerKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+func loadBalancerName(namespace, name string, protocol nbdb.LoadBalancerProtocol) string {
+	return fmt.Sprintf("ovn-kubevirt_%s_%s_%s", namespace, name, protocol)
+}
+
+func loadBalancerProtocol(protocol ovnkubevirtv1alpha1.Protocol) nbdb.LoadBalancerProtocol {
+	switch protocol {
+	case ovnkubevirtv1alpha1.ProtocolUDP:
+		return nbdb.LoadBalancerProtocolUDP
+	case ovnkubevirtv1alpha1.ProtocolSCTP:
+		return nbdb.LoadBalancerProtocolSCTP
+	default:
+		return nbdb.LoadBalancerProtocolTCP
+	}
+}
+
+// ensureTenantLoadBalancer configures the load balancers at the tenant
+// logical switch, for e/w traffic, and at the gateway routers, for n/s
+// traffic, the cluster router is distributed without gateway port so it
+// cannot have them.
+func ensureTenantLoadBalancer(nbcli ovsclient.Client, tlb *ovnkubevirtv1alpha1.TenantLoadBalancer, ls *nbdb.LogicalSwitch, backends []networkPort, nodes []corev1.Node) error {
+	key := tenantLoadBalancerKey(tlb.Namespace, tlb.Name)
+	if net.ParseIP(tlb.Spec.VIP) == nil {
+		return fmt.Errorf("invalid load balancer vip %q", tlb.Spec.VIP)
+	}
+
+	ops := []ovsdb.Operation{}
+	lbs := map[nbdb.LoadBalancerProtocol]*nbdb.LoadBalancer{}
+	for _, port := range tlb.Spec.Ports {
+		protocol := loadBalancerProtocol(port.Protocol)
+		lb, ok := lbs[protocol]
+		if !ok {
+			lb = libovsdbops.BuildLoadBalancer(
+				loadBalancerName(tlb.Namespace, tlb.Name, protocol),
+				protocol,
+				nil,
+				map[string]string{},
+				map[string]string{"reject": "true"},
+				map[string]string{
+					networkExternalIDKey:      tlb.Spec.Network,
+					loadBalancerExternalIDKey: key,
+				},
+			)
+			// Empty instead of nil so they are cleared if the health check
+			// is removed
+			lb.HealthCheck = []string{}
+			lb.IPPortMappings = map[string]string{}
+			lbs[protocol] = lb
+		}
+		targetPort := port.TargetPort
+		if targetPort == 0 {
+			targetPort = port.Port
+		}
+		endpoints := []string{}
+		for _, backend := range backends {
+			endpoints = append(endpoints, net.JoinHostPort(backend.address, strconv.Itoa(int(targetPort))))
+		}
+		lb.Vips[net.JoinHostPort(tlb.Spec.VIP, strconv.Itoa(int(port.Port)))] = strings.Join(endpoints, ",")
+	}
+
+	if tlb.Spec.HealthCheck != nil {
+		var err error
+		ops, err = ensureLoadBalancerHealthChecksOps(nbcli, ops, key, tlb.Spec.HealthCheck, lbs)
+		if err != nil {
+			return err
+		}
+		for _, lb := range lbs {
+			for _, backend := range backends {
+				lb.IPPortMappings[backend.address] = backend.lsp.Name + ":" + tlb.Spec.HealthCheck.SourceIP
+			}
+		}
+	}
+
+	desiredLBs := []*nbdb.LoadBalancer{}
+	desiredNames := map[string]bool{}
+	for _, lb := range lbs {
+		desiredLBs = append(desiredLBs, lb)
+		desiredNames[lb.Name] = true
+	}
+
+	// Remove the load balancers of the protocols no longer used
+	currentLBs, err := findTenantLoadBalancers(nbcli, key)
+	if err != nil {
+		return err
+	}
+	staleLBs := []*nbdb.LoadBalancer{}
+	for _, lb := range currentLBs {
+		if !desiredNames[lb.Name] {
+			staleLBs = append(staleLBs, lb)
+		}
+	}
+	ops, err = libovsdbops.DeleteLoadBalancersOps(nbcli, ops, staleLBs...)
+	if err != nil {
+		return fmt.Errorf("failed removing stale load balancers %s: %v", key, err)
+	}
+
+	ops, err = libovsdbops.CreateOrUpdateLoadBalancersOps(nbcli, ops, desiredLBs...)
+	if err != nil {
+		return fmt.Errorf("failed ensuring load balancers %s: %v", key, err)
+	}
+
+	ops, err = libovsdbops.AddLoadBalancersToLogicalSwitchOps(nbcli, ops, ls, desiredLBs...)
+	if err != nil {
+		return fmt.Errorf("failed adding load balancers %s to %s: %v", key, ls.Name, err)
+	}
+
+	gwRouters, err := loadBalancerRouters(nbcli, tlb.Spec.Network, nodes)
+	if err != nil {
+		return err
+	}
+	for _, gwRouter := range gwRouters {
+		ops, err = libovsdbops.AddLoadBalancersToLogicalRouterOps(nbcli, ops, gwRouter, desiredLBs...)
+		if err != nil {
+			return fmt.Errorf("failed adding load balancers %s to %s: %v", key, gwRouter.Name, err)
+		}
+	}
+
+	if _, err := libovsdbops.TransactAndCheck(nbcli, ops); err != nil {
+		return fmt.Errorf("failed ensuring load balancer %s: %v", key, err)
+	}
+	return nil
+}
+
+// loadBalancerRouters returns the routers implementing the network n/s load
+// balancing. The nodes gateway routers cannot reach the VMs behind a
+// dedicated router, so it's the dedicated router, that has a distributed
+// gateway port, or the network own gateway routers, since the dedicated
+// router connected to them has no gateway port.
+func loadBalancerRouters(nbcli ovsclient.Client, network string, nodes []corev1.Node) ([]*nbdb.LogicalRouter, error) {
+	dedicated, err := isDedicatedRouterNetwork(nbcli, network)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, node := range nodes {
+		names[ovnktypes.GWRouterPrefix+node.Name] = true
+	}
+	gwRouters, err := libovsdbops.FindLogicalRoutersWithPredicate(nbcli, func(item *nbdb.LogicalRouter) bool {
+		if !dedicated {
+			return names[item.Name]
+		}
+		return item.ExternalIDs[networkExternalIDKey] == network && item.ExternalIDs[nodeExternalIDKey] != ""
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed looking for network %s gateway routers: %v", network, err)
+	}
+	if !dedicated || len(gwRouters) > 0 {
+		return gwRouters, nil
+	}
+	tenantRouter, err := libovsdbops.GetLogicalRouter(nbcli, &nbdb.LogicalRouter{Name: tenantRouterName(network)})
+	if err != nil {
+		return nil, fmt.Errorf("failed getting tenant router %s: %v", tenantRouterName(network), err)
+	}
+	return []*nbdb.LogicalRouter{tenantRouter}, nil
+}
+
+func findTenantLoadBalancers(nbcli ovsclient.Client, key string) ([]*nbdb.LoadBalancer, error) {
+	lbs := []*nbdb.LoadBalancer{}
+	if err := nbcli.WhereCache(func(item *nbdb.LoadBalancer) bool {
+		return item.ExternalIDs[loadBalancerExternalIDKey] == key
+	}).List(context.Background(), &lbs); err != nil {
+		return nil, fmt.Errorf("failed looking for load balancer %s: %v", key, err)
+	}
+	return lbs, nil
+}
+
+// ensureLoadBalancerHealthChecksOps creates or updates one health check per
+// load balancer vip, the health checks no longer referenced by the load
+// balancers are garbage collected by the database.
+func ensureLoadBalancerHealthChecksOps(nbcli ovsclient.Client, ops []ovsdb.Operation, key string, healthCheck *ovnkubevirtv1alpha1.TenantLoadBalancerHealthCheck, lbs map[nbdb.LoadBalancerProtocol]*nbdb.LoadBalancer) ([]ovsdb.Operation, error) {
+	if net.ParseIP(healthCheck.SourceIP) == nil {
+		return nil, fmt.Errorf("invalid health check source ip %q", healthCheck.SourceIP)
+	}
+	options := map[string]string{}
+	for option, value := range map[string]int32{
+		"interval":      healthCheck.Interval,
+		"timeout":       healthCheck.Timeout,
+		"success_count": healthCheck.SuccessCount,
+		"failure_count": healthCheck.FailureCount,
+	} {
+		if value > 0 {
+			options[option] = strconv.Itoa(int(value))
+		}
+	}
+
+	existing := []nbdb.LoadBalancerHealthCheck{}
+	if err := nbcli.WhereCache(func(item *nbdb.LoadBalancerHealthCheck) bool {
+		return item.ExternalIDs[loadBalancerExternalIDKey] == key
+	}).List(context.Background(), &existing); err != nil {
+		return nil, fmt.Errorf("failed looking for load balancer %s health checks: %v", key, err)
+	}
+	existingByUUID := map[string]*nbdb.LoadBalancerHealthCheck{}
+	for i := range existing {
+		existingByUUID[existing[i].UUID] = &existing[i]
+	}
+	// The protocols can have the same vip, so the health checks are
+	// identified by the load balancer referencing them and the vip
+	currentLBs, err := findTenantLoadBalancers(nbcli, key)
+	if err != nil {
+		return nil, err
+	}
+	existingByLBVIP := map[string]*nbdb.LoadBalancerHealthCheck{}
+	for _, lb := range currentLBs {
+		for _, uuid := range lb.HealthCheck {
+			if hc, ok := existingByUUID[uuid]; ok {
+				existingByLBVIP[lb.Name+"/"+hc.Vip] = hc
+			}
+		}
+	}
+
+	created := 0
+	reused := map[string]bool{}
+	for _, lb := range lbs {
+		for vip := range lb.Vips {
+			hc := &nbdb.LoadBalancerHealthCheck{
+				Vip:     vip,
+				Options: options,
+				ExternalIDs: map[string]string{
+					loadBalancerExternalIDKey: key,
+				},
+			}
+			// A health check shared between load balancers is only kept
+			// by one of them
+			if current, ok := existingByLBVIP[lb.Name+"/"+vip]; ok && !reused[current.UUID] {
+				reused[current.UUID] = true
+				hc.UUID = current.UUID
+				updateOps, err := nbcli.Where(hc).Update(hc, &hc.Options)
+				if err != nil {
+					return nil, fmt.Errorf("failed updating health check %s: %v", vip, err)
+				}
+				ops = append(ops, updateOps...)
+			} else {
+				// Health checks are not a root table so they have to be
+				// created at the same transaction that references them
+				hc.UUID = fmt.Sprintf("healthcheck%d", created)
+				created++
+				createOps, err := nbcli.Create(hc)
+				if err != nil {
+					return nil, fmt.Errorf("failed creating health check %s: %v", vip, err)
+				}
+				ops = append(ops, createOps...)
+			}
+			lb.HealthCheck = append(lb.HealthCheck, hc.UUID)
+		}
+	}
+	return ops, nil
+}
+
+// deleteTenantLoadBalancer removes the load balancers, they are weakly
+// referenced from the switches and routers and the health checks are
+// garbage collected.
+func deleteTenantLoadBalancer(nbcli ovsclient.Client, key string) error {
+	lbs, err := findTenantLoadBalancers(nbcli, key)
+	if err != nil {
+		return err
+	}
+	if err := libovsdbops.DeleteLoadBalancers(nbcli, lbs); err != nil {
+		return fmt.Errorf("failed deleting load balancer %s: %v", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/libovsdbops"
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+	libovsdbtest "github.com/ovn-org/ovn-kubernetes/go-controller/pkg/testing/libovsdb"
+
+	ovnkubevirtv1alpha1 "github.com/qinqon/ovn-kubevirt/api/v1alpha1"
+)
+
+func TestEnsureLoadBalancerHealthChecks(t *testing.T) {
+	const (
+		key = "ns1/lb1"
+		vip = "192.168.10.100:80"
+	)
+	lbName := func(protocol nbdb.LoadBalancerProtocol) string {
+		return loadBalancerName("ns1", "lb1", protocol)
+	}
+	protocols := []nbdb.LoadBalancerProtocol{nbdb.LoadBalancerProtocolTCP, nbdb.LoadBalancerProtocolUDP}
+
+	tests := []struct {
+		name   string
+		nbData []libovsdbtest.TestData
+	}{
+		{
+			name: "creates one health check per protocol",
+		},
+		{
+			name: "splits the health check shared between protocols",
+			nbData: []libovsdbtest.TestData{
+				&nbdb.LoadBalancerHealthCheck{UUID: "hc-uuid", Vip: vip, ExternalIDs: map[string]string{loadBalancerExternalIDKey: key}},
+				&nbdb.LoadBalancer{UUID: "tcp-uuid", Name: lbName(nbdb.LoadBalancerProtocolTCP), Protocol: &protocols[0], HealthCheck: []string{"hc-uuid"}, ExternalIDs: map[string]string{loadBalancerExternalIDKey: key}},
+				&nbdb.LoadBalancer{UUID: "udp-uuid", Name: lbName(nbdb.LoadBalancerProtocolUDP), Protocol: &protocols[1], HealthCheck: []string{"hc-uuid"}, ExternalIDs: map[string]string{loadBalancerExternalIDKey: key}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nbcli, cleanup, err := libovsdbtest.NewNBTestHarness(libovsdbtest.TestSetup{NBData: tt.nbData}, nil)
+			if err != nil {
+				t.Fatalf("failed creating NB test harness: %v", err)
+			}
+			defer cleanup.Cleanup()
+
+			lbs := map[nbdb.LoadBalancerProtocol]*nbdb.LoadBalancer{}
+			for _, protocol := range protocols {
+				lb := libovsdbops.BuildLoadBalancer(lbName(protocol), protocol, nil, map[string]string{vip: "192.168.10.2:8080"}, nil, map[string]string{loadBalancerExternalIDKey: key})
+				lb.HealthCheck = []string{}
+				lbs[protocol] = lb
+			}
+			healthCheck := &ovnkubevirtv1alpha1.TenantLoadBalancerHealthCheck{SourceIP: "192.168.10.254", Interval: 5}
+			ops, err := ensureLoadBalancerHealthChecksOps(nbcli, nil, key, healthCheck, lbs)
+			if err != nil {
+				t.Fatalf("failed ensuring health checks: %v", err)
+			}
+			for _, lb := range lbs {
+				ops, err = libovsdbops.CreateOrUpdateLoadBalancersOps(nbcli, ops, lb)
+				if err != nil {
+					t.Fatalf("failed ensuring load balancer: %v", err)
+				}
+			}
+			if _, err := libovsdbops.TransactAndCheck(nbcli, ops); err != nil {
+				t.Fatalf("failed committing health checks: %v", err)
+			}
+
+			gotLBs, err := findTenantLoadBalancers(nbcli, key)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(gotLBs) != 2 {
+				t.Fatalf("expected 2 load balancers, got %d", len(gotLBs))
+			}
+			healthChecks := map[string]string{}
+			for _, lb := range gotLBs {
+				if len(lb.HealthCheck) != 1 {
+					t.Fatalf("expected one health check at %s, got %v", lb.Name, lb.HealthCheck)
+				}
+				if other, ok := healthChecks[lb.HealthCheck[0]]; ok {
+					t.Errorf("load balancers %s and %s share the health check", lb.Name, other)
+				}
+				healthChecks[lb.HealthCheck[0]] = lb.Name
+
+				hc := &nbdb.LoadBalancerHealthCheck{UUID: lb.HealthCheck[0]}
+				if err := nbcli.Get(context.Background(), hc); err != nil {
+					t.Fatalf("failed getting %s health check: %v", lb.Name, err)
+				}
+				if hc.Vip != vip || hc.Options["interval"] != "5" {
+					t.Errorf("unexpected %s health check %+v", lb.Name, hc)
+				}
+			}
+		})
+	}
+}
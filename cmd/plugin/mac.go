@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	nadv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	ovsclient "github.com/ovn-org/libovsdb/client"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/libovsdbops"
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+)
+
+// ipToMAC returns the MAC derived from the IPv4 address, like ovn-kubernetes
+// does for the pods
+func ipToMAC(ip net.IP) string {
+	ip4 := ip.To4()
+	return fmt.Sprintf("0a:58:%02x:%02x:%02x:%02x", ip4[0], ip4[1], ip4[2], ip4[3])
+}
+
+// nameToMAC returns a locally administered unicast MAC derived from the name
+// hash, it doesn't overlap with the ones derived from IPs
+func nameToMAC(name string) string {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	sum := h.Sum64()
+	return fmt.Sprintf("02:%02x:%02x:%02x:%02x:%02x", byte(sum>>32), byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum))
+}
+
+// routerPortMAC returns the MAC derived from the router port IP or, if other
+// port of the router already has it, from the port name hash, so the MACs
+// are unique within the router.
+func routerPortMAC(nbcli ovsclient.Client, routerName, portName string, ip net.IP) (string, error) {
+	used, err := routerPortMACs(nbcli, routerName, portName)
+	if err != nil {
+		return "", err
+	}
+	if ip != nil && ip.To4() != nil {
+		if mac := ipToMAC(ip); !used[mac] {
+			return mac, nil
+		}
+	}
+	for i := 0; i < len(used)+1; i++ {
+		key := portName
+		if i > 0 {
+			key = fmt.Sprintf("%s/%d", portName, i)
+		}
+		if mac := nameToMAC(key); !used[mac] {
+			return mac, nil
+		}
+	}
+	return "", fmt.Errorf("failed allocating mac for router port %s", portName)
+}
+
+// routerPortMACs returns the MACs of the router ports except the named one
+func routerPortMACs(nbcli ovsclient.Client, routerName, portName string) (map[string]bool, error) {
+	used := map[string]bool{}
+	lr, err := libovsdbops.GetLogicalRouter(nbcli, &nbdb.LogicalRouter{Name: routerName})
+	if errors.Is(err, ovsclient.ErrNotFound) {
+		return used, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed getting router %s: %v", routerName, err)
+	}
+	ports := map[string]bool{}
+	for _, uuid := range lr.Ports {
+		ports[uuid] = true
+	}
+	lrps := []nbdb.LogicalRouterPort{}
+	if err := nbcli.WhereCache(func(item *nbdb.LogicalRouterPort) bool {
+		return ports[item.UUID] && item.Name != portName
+	}).List(context.Background(), &lrps); err != nil {
+		return nil, fmt.Errorf("failed listing router %s ports: %v", routerName, err)
+	}
+	for _, lrp := range lrps {
+		used[lrp.MAC] = true
+	}
+	return used, nil
+}
+
+// resolveMAC returns the VM interface MAC from the CNI args, the VMI spec
+// interface, the multus annotations of the pod or the interface
+// created by the previous plugin, the first one found. It returns an empty
+// MAC if none of them has it.
+func resolveMAC(ctx *CmdContext, ifName string, prevResult *current.Result) (string, error) {
+	if ctx.mac != "" {
+		return validMAC(ctx.mac, "CNI args")
+	}
+
+	selection, err := networkSelection(ctx.pod, ifName)
+	if err != nil {
+		return "", err
+	}
+	if selection != nil {
+		if ctx.vmi != nil {
+			if mac := vmiInterfaceMAC(ctx.vmi, selection); mac != "" {
+				return validMAC(mac, "VMI interface")
+			}
+		}
+		if selection.MacRequest != "" {
+			return validMAC(selection.MacRequest, nadv1.NetworkAttachmentAnnot+" annotation")
+		}
+	}
+
+	if status := ctx.pod.Annotations[nadv1.NetworkStatusAnnot]; status != "" {
+		statuses := []nadv1.NetworkStatus{}
+		if err := json.Unmarshal([]byte(status), &statuses); err != nil {
+			return "", fmt.Errorf("failed parsing %s annotation: %v", nadv1.NetworkStatusAnnot, err)
+		}
+		for _, s := range statuses {
+			if s.Interface == ifName && s.Mac != "" {
+				return validMAC(s.Mac, nadv1.NetworkStatusAnnot+" annotation")
+			}
+		}
+	}
+
+	for _, iface := range prevResult.Interfaces {
+		if iface.Name == ifName && iface.Sandbox != "" && iface.Mac != "" {
+			return validMAC(iface.Mac, "previous result")
+		}
+	}
+	return "", nil
+}
+
+// validMAC returns the MAC in canonical form if it's an ethernet MAC
+func validMAC(mac, source string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", fmt.Errorf("invalid mac %q from %s: %v", mac, source, err)
+	}
+	if len(hw) != 6 {
+		return "", fmt.Errorf("invalid mac %q from %s: not an ethernet mac", mac, source)
+	}
+	return hw.String(), nil
+}
+
+// networkSelection returns the network selection element of the pod for the
+// interface, the multus interfaces not requested by name are net1, net2...
+// in the order of the selection annotation.
+func networkSelection(pod *corev1.Pod, ifName string) (*nadv1.NetworkSelectionElement, error) {
+	annotation := strings.TrimSpace(pod.Annotations[nadv1.NetworkAttachmentAnnot])
+	if annotation == "" {
+		return nil, nil
+	}
+	elements := []nadv1.NetworkSelectionElement{}
+	if strings.HasPrefix(annotation, "[") {
+		if err := json.Unmarshal([]byte(annotation), &elements); err != nil {
+			return nil, fmt.Errorf("failed parsing %s annotation: %v", nadv1.NetworkAttachmentAnnot, err)
+		}
+	} else {
+		// Comma separated list of [namespace/]name[@interface]
+		for _, item := range strings.Split(annotation, ",") {
+			element := nadv1.NetworkSelectionElement{}
+			name, iface, _ := strings.Cut(strings.TrimSpace(item), "@")
+			element.InterfaceRequest = iface
+			if namespace, name, ok := strings.Cut(name, "/"); ok {
+				element.Namespace = namespace
+				element.Name = name
+			} else {
+				element.Name = name
+			}
+			elements = append(elements, element)
+		}
+	}
+	for i := range elements {
+		element := &elements[i]
+		if element.InterfaceRequest == ifName || (element.InterfaceRequest == "" && ifName == fmt.Sprintf("net%d", i+1)) {
+			if element.Namespace == "" {
+				element.Namespace = pod.Namespace
+			}
+			return element, nil
+		}
+	}
+	return nil, nil
+}
+
+// vmiInterfaceMAC returns the MAC of the VMI interface connected to the
+// multus network selected by the element
+func vmiInterfaceMAC(vmi *kubevirtv1.VirtualMachineInstance, selection *nadv1.NetworkSelectionElement) string {
+	for _, network := range vmi.Spec.Networks {
+		if network.Multus == nil {
+			continue
+		}
+		namespace, name, ok := strings.Cut(network.Multus.NetworkName, "/")
+		if !ok {
+			namespace, name = vmi.Namespace, network.Multus.NetworkName
+		}
+		if namespace != selection.Namespace || name != selection.Name {
+			continue
+		}
+		for _, iface := range vmi.Spec.Domain.Devices.Interfaces {
+			if iface.Name == network.Name {
+				return iface.MacAddress
+			}
+		}
+	}
+	return ""
+}
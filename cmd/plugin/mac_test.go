@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+	libovsdbtest "github.com/ovn-org/ovn-kubernetes/go-controller/pkg/testing/libovsdb"
+)
+
+func TestIPToMAC(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "10.244.0.5", want: "0a:58:0a:f4:00:05"},
+		{ip: "192.168.10.1", want: "0a:58:c0:a8:0a:01"},
+		{ip: "255.255.255.255", want: "0a:58:ff:ff:ff:ff"},
+		{ip: "::ffff:10.0.0.1", want: "0a:58:0a:00:00:01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := ipToMAC(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("ipToMAC(%s) = %s, want %s", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNameToMAC(t *testing.T) {
+	names := []string{"", "net1", "net2", "rtoj-net1", "gtoj-node1", "rtoj-net1/1"}
+	macs := map[string]string{}
+	for _, name := range names {
+		mac := nameToMAC(name)
+		hwAddr, err := net.ParseMAC(mac)
+		if err != nil {
+			t.Fatalf("nameToMAC(%q) = %s is not a MAC: %v", name, mac, err)
+		}
+		// Locally administered unicast
+		if hwAddr[0] != 0x02 {
+			t.Errorf("nameToMAC(%q) = %s is not locally administered unicast", name, mac)
+		}
+		if strings.HasPrefix(mac, "0a:58:") {
+			t.Errorf("nameToMAC(%q) = %s overlaps with the IP derived MACs", name, mac)
+		}
+		if mac != nameToMAC(name) {
+			t.Errorf("nameToMAC(%q) is not stable", name)
+		}
+		if other, ok := macs[mac]; ok {
+			t.Errorf("nameToMAC(%q) and nameToMAC(%q) are both %s", name, other, mac)
+		}
+		macs[mac] = name
+	}
+}
+
+func TestRouterPortMAC(t *testing.T) {
+	ip := net.ParseIP("10.64.0.1")
+	router := func(ports ...*nbdb.LogicalRouterPort) []libovsdbtest.TestData {
+		lr := &nbdb.LogicalRouter{UUID: "router-uuid", Name: "router"}
+		data := []libovsdbtest.TestData{}
+		for _, lrp := range ports {
+			lr.Ports = append(lr.Ports, lrp.UUID)
+			data = append(data, lrp)
+		}
+		return append(data, lr)
+	}
+	port := func(name, mac string) *nbdb.LogicalRouterPort {
+		return &nbdb.LogicalRouterPort{UUID: name + "-uuid", Name: name, MAC: mac}
+	}
+
+	tests := []struct {
+		name   string
+		ip     net.IP
+		nbData []libovsdbtest.TestData
+		want   string
+	}{
+		{
+			name: "missing router",
+			ip:   ip,
+			want: ipToMAC(ip),
+		},
+		{
+			name:   "ip derived mac is free",
+			ip:     ip,
+			nbData: router(port("other", nameToMAC("other"))),
+			want:   ipToMAC(ip),
+		},
+		{
+			name:   "port already has the ip derived mac",
+			ip:     ip,
+			nbData: router(port("port", ipToMAC(ip))),
+			want:   ipToMAC(ip),
+		},
+		{
+			name:   "other port has the ip derived mac",
+			ip:     ip,
+			nbData: router(port("other", ipToMAC(ip))),
+			want:   nameToMAC("port"),
+		},
+		{
+			name:   "other ports have the ip and name derived macs",
+			ip:     ip,
+			nbData: router(port("other", ipToMAC(ip)), port("another", nameToMAC("port"))),
+			want:   nameToMAC("port/1"),
+		},
+		{
+			name:   "without ip",
+			nbData: router(port("other", nameToMAC("other"))),
+			want:   nameToMAC("port"),
+		},
+		{
+			name:   "ipv6",
+			ip:     net.ParseIP("fd00::1"),
+			nbData: router(),
+			want:   nameToMAC("port"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nbcli, cleanup, err := libovsdbtest.NewNBTestHarness(libovsdbtest.TestSetup{NBData: tt.nbData}, nil)
+			if err != nil {
+				t.Fatalf("failed creating NB test harness: %v", err)
+			}
+			defer cleanup.Cleanup()
+
+			got, err := routerPortMAC(nbcli, "router", "port", tt.ip)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("routerPortMAC() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
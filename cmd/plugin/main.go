@@ -24,6 +24,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 
 	"github.com/containernetworking/cni/pkg/skel"
@@ -32,15 +33,17 @@ import (
 	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/ovn-org/libovsdb/model"
-	"github.com/ovn-org/libovsdb/ovsdb"
 	corev1 "k8s.io/api/core/v1"
 	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/tools/clientcmd"
 
 	kubevirtv1 "kubevirt.io/api/core/v1"
 
+	ovnkubevirtv1alpha1 "github.com/qinqon/ovn-kubevirt/api/v1alpha1"
+
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	k8sclient "sigs.k8s.io/controller-runtime/pkg/client"
 
@@ -54,6 +57,42 @@ import (
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 )
 
+const (
+	// networkExternalIDKey is set at the NB objects external ids with the
+	// name of the tenant network that owns them
+	networkExternalIDKey = "ovn-kubevirt/network"
+	// egressNodesExternalIDKey is set at the egress ip NAT with the nodes
+	// that can be used as egress gateway
+	egressNodesExternalIDKey = "ovn-kubevirt/egress-nodes"
+	// floatingIPExternalIDKey is set at the floating ip NAT with the
+	// namespace and name of the FloatingIP
+	floatingIPExternalIDKey = "ovn-kubevirt/floating-ip"
+	// loadBalancerExternalIDKey is set at the load balancers and health
+	// checks with the namespace and name of the TenantLoadBalancer
+	loadBalancerExternalIDKey = "ovn-kubevirt/load-balancer"
+	// networkPolicyExternalIDKey is set at the port groups, ACLs and
+	// address sets with the namespace and name of the TenantNetworkPolicy
+	networkPolicyExternalIDKey = "ovn-kubevirt/network-policy"
+	// networkPolicyRuleExternalIDKey is set at the ACLs with the
+	// TenantNetworkPolicy rule they implement
+	networkPolicyRuleExternalIDKey = "ovn-kubevirt/network-policy-rule"
+	// vmiExternalIDKey is set at the NB objects of a VMI with its namespace
+	// and name
+	vmiExternalIDKey = "ovn-kubevirt/vmi"
+	// podExternalIDKey is set at the NB objects of a plain pod, not a
+	// virt-launcher one, with its namespace and name
+	podExternalIDKey = "ovn-kubevirt/pod"
+	// nodeExternalIDKey is set at the NB objects of a node gateway router
+	// with the node name
+	nodeExternalIDKey = "ovn-kubevirt/node"
+	// gatewayNodeExternalIDKey is set at the VM reroute policy or source
+	// route with the node whose gateway router is used while it's ready
+	gatewayNodeExternalIDKey = "ovn-kubevirt/gateway-node"
+	// portExternalIDKey is set at the VM reroute policy or source route
+	// with the switch port of the VMI interface
+	portExternalIDKey = "ovn-kubevirt/port"
+)
+
 var (
 	pluginscheme = runtime.NewScheme()
 	enabled      = true
@@ -66,6 +105,9 @@ func init() {
 	if err := kubevirtv1.AddToScheme(pluginscheme); err != nil {
 		panic(err)
 	}
+	if err := ovnkubevirtv1alpha1.AddToScheme(pluginscheme); err != nil {
+		panic(err)
+	}
 }
 
 type PluginConf struct {
@@ -74,6 +116,130 @@ type PluginConf struct {
 	LeaseTime  string `json:"lease-time"`
 	Subnet     string `json:"subnet"`
 	ExcludeIps string `json:"exclude-ips"`
+	// EgressIP is used to masquerade the tenant subnet at one gateway
+	// router instead of using the IP of the node where the VM is running
+	EgressIP string `json:"egress-ip"`
+	// EgressNodes are the nodes that can be used as egress gateway, all of
+	// them if empty
+	EgressNodes []string `json:"egress-nodes"`
+	// Masquerade can be disabled for tenant subnets routed at the
+	// datacenter, then the subnet is advertised at the nodes instead
+	Masquerade *bool `json:"masquerade"`
+	// InfraSubnets are the infra cluster pod and join subnets, the VMs
+	// e/w traffic to them is not sent to the gateway routers
+	InfraSubnets []string `json:"infra-subnets"`
+	// ServiceSubnets are the infra cluster service subnets
+	ServiceSubnets []string `json:"service-subnets"`
+	// Isolation drops the tenant traffic to the infra subnets and service
+	// subnets except the one at IsolationAllow
+	Isolation bool `json:"isolation"`
+	// IsolationAllow are the infra destinations reachable from an isolated
+	// tenant network, only the kube-dns service if not set
+	IsolationAllow []IsolationAllowRule `json:"isolation-allow"`
+	// DedicatedRouter connects the tenant switch to its own router instead
+	// of ovn_cluster_router, so the tenant subnets can overlap
+	DedicatedRouter bool `json:"dedicated-router"`
+	// TransitSubnet is used to connect the dedicated routers to the gateway
+	// routers
+	TransitSubnet string `json:"transit-subnet"`
+	// Gateway makes the tenant network use its own gateway routers instead
+	// of the ovn-kubernetes ones, it implies a dedicated router
+	Gateway *GatewayConf `json:"gateway"`
+	// Routing selects how the VMs n/s traffic is sent to their gateway
+	// router, "policy" (default) or "source-route"
+	Routing string `json:"routing"`
+	// Topology is "layer3" (default) to route the tenant network or
+	// "layer2" to only create its switch and ports, DHCP is served at
+	// layer2 networks if Router is set
+	Topology string `json:"topology"`
+}
+
+// GatewayConf configures the tenant network dedicated gateway routers
+type GatewayConf struct {
+	// JoinSubnet is split in /30 subnets to connect the dedicated router
+	// with each gateway router
+	JoinSubnet string `json:"join-subnet"`
+	// PhysicalNetwork is the localnet network name of the gateway routers
+	// external switches
+	PhysicalNetwork string `json:"physical-network"`
+	// NextHop is the default gateway of the gateway routers
+	NextHop string `json:"next-hop"`
+	// Nodes are the nodes where the gateway routers are scheduled
+	Nodes []GatewayNodeConf `json:"nodes"`
+}
+
+// GatewayNodeConf is the external address of the gateway router at a node
+type GatewayNodeConf struct {
+	Name string `json:"name"`
+	// Address is the gateway router external CIDR address
+	Address string `json:"address"`
+}
+
+func (c *GatewayConf) joinSubnet() string {
+	if c.JoinSubnet == "" {
+		return "10.65.0.0/16"
+	}
+	return c.JoinSubnet
+}
+
+func (c *GatewayConf) physicalNetwork() string {
+	if c.PhysicalNetwork == "" {
+		return ovnktypes.PhysicalNetworkName
+	}
+	return c.PhysicalNetwork
+}
+
+// IsolationAllowRule matches traffic by destination and optionally by
+// protocol and port
+type IsolationAllowRule struct {
+	CIDR     string `json:"cidr"`
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+}
+
+func (c *PluginConf) masquerade() bool {
+	return c.Masquerade == nil || *c.Masquerade
+}
+
+// dedicatedRouter returns true if the tenant network has its own router,
+// isolated networks and networks with dedicated gateway always have it
+func (c *PluginConf) dedicatedRouter() bool {
+	return c.DedicatedRouter || c.Isolation || c.Gateway != nil
+}
+
+func (c *PluginConf) routing() string {
+	if c.Routing == "" {
+		return policyRouting
+	}
+	return c.Routing
+}
+
+func (c *PluginConf) topology() string {
+	if c.Topology == "" {
+		return layer3Topology
+	}
+	return c.Topology
+}
+
+func (c *PluginConf) transitSubnet() string {
+	if c.TransitSubnet == "" {
+		return "10.64.0.0/16"
+	}
+	return c.TransitSubnet
+}
+
+func (c *PluginConf) infraSubnets() []string {
+	if len(c.InfraSubnets) == 0 {
+		return []string{"10.244.0.0/16", "100.64.0.0/16"}
+	}
+	return c.InfraSubnets
+}
+
+func (c *PluginConf) serviceSubnets() []string {
+	if len(c.ServiceSubnets) == 0 {
+		return []string{"10.96.0.0/16"}
+	}
+	return c.ServiceSubnets
 }
 
 type ExtraArgs struct {
@@ -82,22 +248,47 @@ type ExtraArgs struct {
 }
 
 type CmdContext struct {
-	k8scli       k8sclient.Client
-	nbcli        ovsclient.Client
-	sbcli        ovsclient.Client
-	conf         *PluginConf
-	mac          string
-	vmi          *kubevirtv1.VirtualMachineInstance
-	virtLauncher *corev1.Pod
-	gateway      *Gateway
-	joinRouter   *JoinRouter
-	hostname     string
+	k8scli k8sclient.Client
+	nbcli  ovsclient.Client
+	sbcli  ovsclient.Client
+	conf   *PluginConf
+	mac    string
+	// vmi is nil for plain pods attached to the tenant network
+	vmi        *kubevirtv1.VirtualMachineInstance
+	pod        *corev1.Pod
+	gateway    *Gateway
+	joinRouter *JoinRouter
+	hostname   string
+	// gatewayNode is the node whose gateway router is used for the VM
+	// n/s traffic
+	gatewayNode string
+	// portName is the switch port of the VMI or pod interface
+	portName string
+}
+
+// ownerName returns the name of the VMI, or the pod if it's a plain pod
+func (c *CmdContext) ownerName() string {
+	if c.vmi == nil {
+		return c.pod.Name
+	}
+	return c.vmi.Name
+}
+
+// ownerExternalIDs returns the external ids that identify the VMI, or the pod
+// if it's a plain pod, at its NB objects
+func (c *CmdContext) ownerExternalIDs() map[string]string {
+	if c.vmi == nil {
+		return map[string]string{podExternalIDKey: podKey(c.pod)}
+	}
+	return map[string]string{vmiExternalIDKey: vmiKey(c.vmi)}
 }
 
 type GatewayRouter struct {
 	lr       *nbdb.LogicalRouter
 	gwPort   *nbdb.LogicalRouterPort
 	joinPort *nbdb.LogicalRouterPort
+	// joinPeer is the dedicated router port connected to joinPort
+	joinPeer *nbdb.LogicalRouterPort
 }
 
 type Gateway struct {
@@ -108,6 +299,12 @@ type JoinRouter struct {
 	lr          *nbdb.LogicalRouter
 	gwPorts     map[string]*nbdb.LogicalRouterPort
 	tenantPorts map[string]*nbdb.LogicalRouterPort
+	// transitPort connects a dedicated router to the transit switch
+	transitPort *nbdb.LogicalRouterPort
+	// legacyTransitLSP is the transit switch port of transitPort to rename
+	legacyTransitLSP *nbdb.LogicalSwitchPort
+	// gwAddresses are the nexthops to the gateway routers by node
+	gwAddresses map[string]string
 }
 
 // parseConfig parses the supplied configuration (and prevResult) from stdin.
@@ -131,7 +328,6 @@ func parseConfig(stdin []byte) (*PluginConf, error) {
 
 // cmdAdd is called for ADD requests
 func cmdAdd(args *skel.CmdArgs) error {
-	logCall("FOO", args)
 	logCall("ADD", args)
 	ctx, err := loadCmdContext(args)
 	if err != nil {
@@ -147,59 +343,148 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return fmt.Errorf("failed to convert prevResult: %v", err)
 	}
 
-	portName := composePortName(ctx.vmi.Namespace, ctx.vmi.Name)
+	ctx.mac, err = resolveMAC(ctx, args.IfName, prevResult)
+	if err != nil {
+		return err
+	}
+
+	if err := checkSubnetOverlap(ctx); err != nil {
+		return err
+	}
+
+	if ctx.conf.dedicatedRouter() && !ctx.conf.masquerade() {
+		return fmt.Errorf("masquerade cannot be disabled with a dedicated router")
+	}
+
+	if ctx.conf.Gateway != nil && ctx.conf.EgressIP != "" {
+		return fmt.Errorf("egress ip cannot be configured with dedicated gateway")
+	}
+
+	if !ctx.conf.masquerade() && ctx.conf.EgressIP != "" {
+		return fmt.Errorf("egress ip cannot be configured with masquerade disabled")
+	}
+
+	switch ctx.conf.routing() {
+	case policyRouting:
+	case sourceRouting:
+		if !ctx.conf.dedicatedRouter() {
+			return fmt.Errorf("source-route routing needs a dedicated router")
+		}
+	default:
+		return fmt.Errorf("invalid routing %q", ctx.conf.Routing)
+	}
+
+	layer2 := false
+	switch ctx.conf.topology() {
+	case layer3Topology:
+	case layer2Topology:
+		if err := checkLayer2Conf(ctx.conf); err != nil {
+			return err
+		}
+		layer2 = true
+	default:
+		return fmt.Errorf("invalid topology %q", ctx.conf.Topology)
+	}
+
+	portName := composePortName(ctx.pod.Namespace, ctx.ownerName(), ctx.conf.Name, args.IfName)
+	ctx.portName = portName
 	output, err := runOVSVsctl(ctx, "add", "Interface", prevResult.Interfaces[0].Name, "external_ids", fmt.Sprintf("iface-id=%s", portName))
 	if err != nil {
 		return fmt.Errorf("%s: %v", output, err)
 	}
 
-	ctx.joinRouter = newJoinRouter()
-	ctx.joinRouter.addTenantPort(ctx)
+	// All the NB changes are committed at a single transaction, so a failed
+	// ADD leaves nothing behind and it can be retried with the same args
+	t := newNBTxn(ctx.nbcli)
 
-	if err := ctx.joinRouter.ensure(ctx); err != nil {
-		return fmt.Errorf("failed ensuring join router: %v", err)
+	if !layer2 {
+		if err := ensureTenantRouters(ctx, t); err != nil {
+			return err
+		}
 	}
+
 	ls := nbdb.LogicalSwitch{
 		Name: ctx.conf.Name,
 		OtherConfig: map[string]string{
 			"subnet":      ctx.conf.Subnet,
 			"exclude_ips": ctx.conf.ExcludeIps,
 		},
+		ExternalIDs: map[string]string{
+			networkExternalIDKey: ctx.conf.Name,
+		},
 	}
-
-	address := "dynamic"
-	// virt-launcher pod has the mac on the annotation
-	if ctx.mac != "" {
-		address = ctx.mac + " " + address
+	if layer2 {
+		ls.ExternalIDs[topologyExternalIDKey] = layer2Topology
 	}
+	ls.ExternalIDs[advertisedExternalIDKey] = strconv.FormatBool(!ctx.conf.masquerade())
 
-	dnsServer, err := kubeDNSNameServer(ctx)
+	existingLS, err := findSwitch(ctx.nbcli, ls.Name)
 	if err != nil {
 		return err
 	}
+	// The port created before it had the network and the interface at the
+	// name is replaced by the new one keeping its address
+	addressPort := portName
+	var legacyLSP *nbdb.LogicalSwitchPort
+	if ctx.vmi != nil {
+		legacyLSP, err = legacySwitchPort(ctx.nbcli, existingLS, ctx.vmi)
+		if err != nil {
+			return err
+		}
+	}
+	if legacyLSP != nil {
+		addressPort = legacyLSP.Name
+	}
+	vmAddress, err := vmAddress(ctx, existingLS, addressPort)
+	if err != nil {
+		return err
+	}
+	if existingLS != nil {
+		if err := t.waitSwitchPorts(existingLS); err != nil {
+			return err
+		}
+	} else {
+		t.waitNoSwitch(ls.Name)
+	}
+	if legacyLSP != nil {
+		if err := t.remove(existingLS, &existingLS.Ports, legacyLSP.UUID); err != nil {
+			return fmt.Errorf("failed removing legacy switch port %s: %v", legacyLSP.Name, err)
+		}
+	}
 
-	dhcpOptions := nbdb.DHCPOptions{
-		Cidr: ctx.conf.Subnet,
-		Options: map[string]string{
-			"lease_time": ctx.conf.LeaseTime,
-			"router":     ctx.conf.Router,
-			"dns_server": dnsServer,
-			"server_id":  ctx.conf.Router,
-			"server_mac": "c0:ff:ee:00:00:01",
-		},
+	// ovn-northd assigns a MAC if it cannot be resolved
+	address := "dynamic " + vmAddress
+	if ctx.mac != "" {
+		address = ctx.mac + " " + vmAddress
 	}
 
-	if err := ensureDHCPOptions(ctx, &dhcpOptions); err != nil {
+	var dhcpOptions *nbdb.DHCPOptions
+	if layer2 {
+		dhcpOptions, err = layer2DHCPOptions(ctx)
+	} else {
+		dhcpOptions, err = tenantDHCPOptions(ctx)
+	}
+	if err != nil {
 		return err
 	}
-	lsps := []*nbdb.LogicalSwitchPort{
-		&nbdb.LogicalSwitchPort{
-			Name:          portName,
-			Addresses:     []string{address},
-			Enabled:       &enabled,
-			Dhcpv4Options: &dhcpOptions.UUID,
-		},
-		&nbdb.LogicalSwitchPort{
+
+	portExternalIDs := ctx.ownerExternalIDs()
+	portExternalIDs[networkExternalIDKey] = ctx.conf.Name
+	lsp := &nbdb.LogicalSwitchPort{
+		Name:        portName,
+		Addresses:   []string{address},
+		Enabled:     &enabled,
+		ExternalIDs: portExternalIDs,
+	}
+	if dhcpOptions != nil {
+		if err := ensureDHCPOptions(ctx, t, dhcpOptions); err != nil {
+			return err
+		}
+		lsp.Dhcpv4Options = &dhcpOptions.UUID
+	}
+	lsps := []*nbdb.LogicalSwitchPort{lsp}
+	if !layer2 {
+		lsps = append(lsps, &nbdb.LogicalSwitchPort{
 			Name:      ctx.conf.Name + "-to-ovn_cluster_router",
 			Type:      "router",
 			Addresses: []string{"router"},
@@ -207,32 +492,149 @@ func cmdAdd(args *skel.CmdArgs) error {
 			Options: map[string]string{
 				"router-port": ctx.conf.Name,
 			},
-		},
+			ExternalIDs: map[string]string{
+				networkExternalIDKey: ctx.conf.Name,
+			},
+		})
 	}
-	if err := libovsdbops.CreateOrUpdateLogicalSwitchPortsAndSwitch(ctx.nbcli, &ls, lsps...); err != nil {
-		return fmt.Errorf("failed ensuring tenant logical switch and ports: %v", err)
+	if err := t.ensureSwitch(&ls); err != nil {
+		return fmt.Errorf("failed ensuring tenant logical switch: %v", err)
+	}
+	for _, lsp := range lsps {
+		if err := t.ensureSwitchPort(ls.Name, lsp); err != nil {
+			return fmt.Errorf("failed ensuring tenant logical switch ports: %v", err)
+		}
 	}
 
-	if err := masqueradeTenantSubnet(ctx); err != nil {
+	// The tenant router VM routes the layer2 networks
+	if !layer2 {
+		if err := routeVM(ctx, t, vmAddress); err != nil {
+			return err
+		}
+	}
+
+	if err := t.commit(); err != nil {
+		return fmt.Errorf("failed commiting tenant network %s: %v", ctx.conf.Name, err)
+	}
+
+	// The gateway routers route the tenant subnet once it's committed, the
+	// subnet is withdrawn if masquerade has been enabled
+	nodes, err := nodes(ctx)
+	if err != nil {
+		return err
+	}
+	if err := syncAdvertisedSubnets(context.Background(), ctx.k8scli, ctx.nbcli, nodes); err != nil {
 		return err
 	}
 
-	if err := routeTenantSubnetToJoinRouter(ctx); err != nil {
+	return types.PrintResult(&current.Result{}, ctx.conf.CNIVersion)
+}
+
+// ensureTenantRouters ensures the router the tenant switch is connected to,
+// and the dedicated gateway routers or the transit switch if it's a
+// dedicated router
+func ensureTenantRouters(ctx *CmdContext, t *nbTxn) error {
+	var err error
+	ctx.joinRouter = newJoinRouter(ctx)
+	if err := ctx.joinRouter.addTenantPort(ctx); err != nil {
 		return err
 	}
+	if ctx.conf.Gateway != nil {
+		ctx.gateway, err = newGateway(ctx)
+		if err != nil {
+			return err
+		}
+	} else if ctx.conf.dedicatedRouter() {
+		if err := ctx.joinRouter.addTransitPort(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.joinRouter.ensure(ctx, t); err != nil {
+		return fmt.Errorf("failed ensuring join router: %v", err)
+	}
+
+	if ctx.gateway != nil {
+		if err := ctx.gateway.ensure(ctx, t); err != nil {
+			return err
+		}
+	} else if ctx.conf.dedicatedRouter() {
+		if err := ctx.joinRouter.ensureTransit(ctx, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tenantDHCPOptions returns the DHCP options of the routed tenant network,
+// served by the tenant router port
+func tenantDHCPOptions(ctx *CmdContext) (*nbdb.DHCPOptions, error) {
+	dnsServer, err := kubeDNSNameServer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &nbdb.DHCPOptions{
+		Cidr: ctx.conf.Subnet,
+		Options: map[string]string{
+			"lease_time": ctx.conf.LeaseTime,
+			"router":     ctx.conf.Router,
+			"dns_server": dnsServer,
+			"server_id":  ctx.conf.Router,
+			"server_mac": ctx.joinRouter.tenantPorts[ctx.conf.Name].MAC,
+		},
+	}, nil
+}
 
-	if err := ctx.joinRouter.routeDynamicAddressToGw(ctx, lsps[0]); err != nil {
+// routeVM masquerades the tenant subnet and sends the VM n/s traffic to its
+// gateway router
+func routeVM(ctx *CmdContext, t *nbTxn, vmAddress string) error {
+	var err error
+	ctx.gatewayNode = ctx.hostname
+	if ctx.gateway != nil {
+		// The dedicated gateway routers masquerade the tenant subnet
+		ctx.gatewayNode = ctx.gateway.node(ctx, ctx.hostname)
+	} else if !ctx.conf.masquerade() {
+		if err := unmasqueradeTenantSubnet(ctx, t); err != nil {
+			return err
+		}
+	} else if ctx.conf.EgressIP != "" {
+		ctx.gatewayNode, err = ensureEgressIP(ctx, t)
+		if err != nil {
+			return fmt.Errorf("failed ensuring egress ip: %v", err)
+		}
+	} else if err := masqueradeTenantSubnet(ctx, t); err != nil {
 		return err
 	}
 
-	return types.PrintResult(&current.Result{}, ctx.conf.CNIVersion)
+	// The dedicated router masquerades the tenant subnet with its transit
+	// port address, which is directly connected to the gateway routers
+	if !ctx.conf.dedicatedRouter() {
+		if err := routeTenantSubnetToJoinRouter(ctx, t); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.joinRouter.routeDynamicAddressToGw(ctx, t, vmAddress); err != nil {
+		return err
+	}
+
+	// The VMI n/s traffic may have been moved to a different gateway router
+	// so the floating ips have to follow it
+	if err := ensureVMIFloatingIPs(ctx, t, vmAddress); err != nil {
+		return err
+	}
+
+	return nil
 }
 
 // cmdDel is called for DELETE requests
 func cmdDel(args *skel.CmdArgs) error {
-	return nil
 	logCall("DEL", args)
 	ctx, err := loadCmdContext(args)
+	if apierrors.IsNotFound(err) {
+		// The ports of the gone pods and VMIs are removed by the sweep
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -240,14 +642,30 @@ func cmdDel(args *skel.CmdArgs) error {
 	// If this is the origin virt-launcher pod of a live migrated vmi
 	// don't remove the logical switch, it's being use by the target
 	// virt-launcher pod
-	if ctx.vmi.Status.MigrationState != nil && ctx.vmi.Status.MigrationState.TargetPod != ctx.virtLauncher.Name {
+	if ctx.vmi != nil && ctx.vmi.Status.MigrationState != nil && ctx.vmi.Status.MigrationState.TargetPod != ctx.pod.Name {
 		return nil
 	}
 
-	portName := composePortName(ctx.vmi.Namespace, ctx.vmi.Name)
-	if err := libovsdbops.DeleteLogicalSwitchPorts(ctx.nbcli, &nbdb.LogicalSwitch{Name: ctx.conf.Name}, &nbdb.LogicalSwitchPort{Name: portName}); err != nil {
+	ls, err := findSwitch(ctx.nbcli, ctx.conf.Name)
+	if err != nil {
 		return err
 	}
+	if ls == nil {
+		return nil
+	}
+	lsps := []*nbdb.LogicalSwitchPort{{Name: composePortName(ctx.pod.Namespace, ctx.ownerName(), ctx.conf.Name, args.IfName)}}
+	if ctx.vmi != nil {
+		legacy, err := legacySwitchPort(ctx.nbcli, ls, ctx.vmi)
+		if err != nil {
+			return err
+		}
+		if legacy != nil {
+			lsps = append(lsps, legacy)
+		}
+	}
+	if err := libovsdbops.DeleteLogicalSwitchPorts(ctx.nbcli, ls, lsps...); err != nil {
+		return fmt.Errorf("failed deleting switch ports: %v", err)
+	}
 
 	//FIXME: Switch has to be delete on "tenant" removal
 	/*
@@ -264,30 +682,46 @@ func cmdCheck(args *skel.CmdArgs) error {
 }
 
 func main() {
+	// The CNI runtime calls the plugin without arguments, so they are used
+	// to run the rest of the components from the same binary
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "controller":
+			if err := runController(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "sweep":
+			if err := runSweep(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
 	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("OVN kubevirt"))
 }
 
-func newNBClient(ctx *CmdContext) (ovsclient.Client, error) {
+func newNBClient(k8scli k8sclient.Client) (ovsclient.Client, error) {
 	ovsNbModel, err := nbdb.FullDatabaseModel()
 	if err != nil {
 		return nil, err
 	}
 
-	return newOVSClient(ctx, ovsNbModel, "6641")
+	return newOVSClient(k8scli, ovsNbModel, "6641")
 }
 
-func newSBClient(ctx *CmdContext) (ovsclient.Client, error) {
+func newSBClient(k8scli k8sclient.Client) (ovsclient.Client, error) {
 	ovsSbModel, err := sbdb.FullDatabaseModel()
 	if err != nil {
 		return nil, err
 	}
 
-	return newOVSClient(ctx, ovsSbModel, "6642")
+	return newOVSClient(k8scli, ovsSbModel, "6642")
 }
 
-func newOVSClient(ctx *CmdContext, ovsModel model.ClientDBModel, port string) (ovsclient.Client, error) {
+func newOVSClient(k8scli k8sclient.Client, ovsModel model.ClientDBModel, port string) (ovsclient.Client, error) {
 	endpointSliceList := &discoveryv1.EndpointSliceList{}
-	if err := ctx.k8scli.List(context.Background(), endpointSliceList,
+	if err := k8scli.List(context.Background(), endpointSliceList,
 		client.InNamespace("ovn-kubernetes"),
 		client.MatchingLabels(map[string]string{"kubernetes.io/service-name": "ovnkube-db"})); err != nil {
 		return nil, err
@@ -328,8 +762,25 @@ func newK8SClient() (k8sclient.Client, error) {
 	return k8sclient.New(restCfg, k8sclient.Options{Scheme: pluginscheme})
 }
 
-func composePortName(podNamespace, podName string) string {
-	return podNamespace + "_" + podName
+// composePortName returns the name of the VMI interface switch port, it has
+// the network and the pod interface so a VMI can be attached to several
+// tenant networks or several times to the same one
+func composePortName(namespace, vmiName, network, ifName string) string {
+	return namespace + "_" + vmiName + "_" + network + "_" + ifName
+}
+
+// legacyPortName is the name of the VMI switch port before it had the
+// network and the interface
+func legacyPortName(namespace, vmiName string) string {
+	return namespace + "_" + vmiName
+}
+
+func vmiKey(vmi *kubevirtv1.VirtualMachineInstance) string {
+	return vmi.Namespace + "/" + vmi.Name
+}
+
+func podKey(pod *corev1.Pod) string {
+	return pod.Namespace + "/" + pod.Name
 }
 
 func logCall(command string, args *skel.CmdArgs) {
@@ -338,15 +789,13 @@ func logCall(command string, args *skel.CmdArgs) {
 }
 
 func parseArgs(envArgsString string) (*ExtraArgs, error) {
+	e := ExtraArgs{}
 	if envArgsString != "" {
-		e := ExtraArgs{}
-		err := cnitypes.LoadArgs(envArgsString, &e)
-		if err != nil {
-			return nil, err
+		if err := cnitypes.LoadArgs(envArgsString, &e); err != nil {
+			return nil, fmt.Errorf("failed parsing CNI args: %v", err)
 		}
-		return &e, nil
 	}
-	return nil, nil
+	return &e, nil
 }
 
 func runOVSVsctl(ctx *CmdContext, args ...string) (string, error) {
@@ -381,12 +830,12 @@ func loadCmdContext(args *skel.CmdArgs) (*CmdContext, error) {
 	if err != nil {
 		return nil, err
 	}
-	ctx.nbcli, err = newNBClient(&ctx)
+	ctx.nbcli, err = newNBClient(ctx.k8scli)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx.sbcli, err = newSBClient(&ctx)
+	ctx.sbcli, err = newSBClient(ctx.k8scli)
 	if err != nil {
 		return nil, err
 	}
@@ -410,65 +859,36 @@ func loadCmdContext(args *skel.CmdArgs) (*CmdContext, error) {
 		return nil, fmt.Errorf("missing K8S_POD_NAME")
 	}
 
-	ctx.virtLauncher = &corev1.Pod{}
-	if err := ctx.k8scli.Get(context.Background(), k8sclient.ObjectKey{Namespace: string(extraArgs.K8S_POD_NAMESPACE), Name: string(extraArgs.K8S_POD_NAME)}, ctx.virtLauncher); err != nil {
+	ctx.pod = &corev1.Pod{}
+	if err := ctx.k8scli.Get(context.Background(), k8sclient.ObjectKey{Namespace: string(extraArgs.K8S_POD_NAMESPACE), Name: string(extraArgs.K8S_POD_NAME)}, ctx.pod); err != nil {
 		return nil, err
 	}
 
-	if ctx.virtLauncher.Labels == nil {
-		return nil, fmt.Errorf("missing virt-launcher labels")
-	}
-	vmName, ok := ctx.virtLauncher.Labels["vm.kubevirt.io/name"]
+	// Plain pods, not virt-launcher ones, have no VMI
+	vmName, ok := ctx.pod.Labels["vm.kubevirt.io/name"]
 	if !ok {
-		return nil, fmt.Errorf("missing virt-launcher label vm.kubevirt.io/name")
+		return &ctx, nil
 	}
 
 	ctx.vmi = &kubevirtv1.VirtualMachineInstance{}
-	if err := ctx.k8scli.Get(context.Background(), k8sclient.ObjectKey{Namespace: ctx.virtLauncher.Namespace, Name: vmName}, ctx.vmi); err != nil {
+	if err := ctx.k8scli.Get(context.Background(), k8sclient.ObjectKey{Namespace: ctx.pod.Namespace, Name: vmName}, ctx.vmi); err != nil {
 		return nil, err
 	}
 	return &ctx, nil
 }
 
-func ensureDHCPOptions(ctx *CmdContext, dhcpOptions *nbdb.DHCPOptions) error {
-	dhcpOptionsResult := []nbdb.DHCPOptions{}
-	if err := ctx.nbcli.List(context.Background(), &dhcpOptionsResult); err != nil {
-		return fmt.Errorf("failed listing dhcp options: %v", err)
-	}
-	ops := []ovsdb.Operation{}
-	if len(dhcpOptionsResult) == 0 {
-		var err error
-		ops, err = ctx.nbcli.Create(dhcpOptions)
-		if err != nil {
-			return fmt.Errorf("failed creating dhcp options: %v", err)
-		}
-	} else {
-		for _, d := range dhcpOptionsResult {
-			if d.Cidr == ctx.conf.Subnet {
-				var err error
-				ops, err = ctx.nbcli.Where(&d).Update(dhcpOptions)
-				if err != nil {
-					return fmt.Errorf("failed updating dhcp options: %v", err)
-				}
-				break
-			}
-		}
-	}
-
-	_, err := libovsdbops.TransactAndCheck(ctx.nbcli, ops)
-	if err != nil {
-		return fmt.Errorf("failed commiting dhcp options: %v", err)
-	}
-
-	dhcpOptionsResult = []nbdb.DHCPOptions{}
-	if err := ctx.nbcli.List(context.Background(), &dhcpOptionsResult); err != nil {
-		return fmt.Errorf("failed listing dhcp options: %v", err)
-	}
-	if len(dhcpOptionsResult) == 0 {
-		return fmt.Errorf("missing dhcp options")
-	}
-	*dhcpOptions = dhcpOptionsResult[0]
-	return nil
+// ensureDHCPOptions creates or updates the tenant network DHCP options, they
+// are identified by the network since tenant subnets can overlap
+func ensureDHCPOptions(ctx *CmdContext, t *nbTxn, dhcpOptions *nbdb.DHCPOptions) error {
+	dhcpOptions.ExternalIDs = map[string]string{
+		networkExternalIDKey: ctx.conf.Name,
+	}
+	return t.ensureDHCPOptions(dhcpOptions, func(item *nbdb.DHCPOptions) bool {
+		network, ok := item.ExternalIDs[networkExternalIDKey]
+		// DHCP options created before they had the network are identified
+		// by the subnet
+		return network == ctx.conf.Name || (!ok && item.Cidr == ctx.conf.Subnet)
+	})
 }
 
 func kubeDNSNameServer(ctx *CmdContext) (string, error) {
@@ -502,24 +922,38 @@ func nodes(ctx *CmdContext) ([]corev1.Node, error) {
 
 // of type src-ip [VM IP -> gw router ip] since it has higher priority than the
 // router ports subnet, so we need to implement it with policies
-func (j *JoinRouter) routeDynamicAddressToGw(ctx *CmdContext, lsp *nbdb.LogicalSwitchPort) error {
+func (j *JoinRouter) routeDynamicAddressToGw(ctx *CmdContext, t *nbTxn, vmAddress string) error {
+	if ctx.conf.routing() == sourceRouting {
+		if err := j.ensureSourceRoutes(ctx, t, vmAddress); err != nil {
+			return err
+		}
+		return j.ensureIsolationPolicy(ctx, t)
+	}
 
-	if err := j.ensureDummyRoute(ctx); err != nil {
+	if err := j.ensureDummyRoute(ctx, t); err != nil {
 		return err
 	}
 
-	if err := j.ensureKeepInternalTrafficNextHopPolicy(ctx); err != nil {
+	// The dedicated router reaches the infra cluster through the gateway
+	// routers
+	if !ctx.conf.dedicatedRouter() {
+		if err := j.ensureKeepInternalTrafficNextHopPolicy(ctx, t); err != nil {
+			return err
+		}
+	}
+
+	if err := j.ensureIsolationPolicy(ctx, t); err != nil {
 		return err
 	}
 
-	if err := j.ensureRerouteToGwPolicy(ctx, lsp); err != nil {
+	if err := j.ensureRerouteToGwPolicy(ctx, t, vmAddress); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (j *JoinRouter) ensureDummyRoute(ctx *CmdContext) error {
+func (j *JoinRouter) ensureDummyRoute(ctx *CmdContext, t *nbTxn) error {
 
 	// Add a dummy route to match the tenant cluster so we can continue implementing
 	// routing with policies (if there is no match policies are not run).
@@ -527,88 +961,123 @@ func (j *JoinRouter) ensureDummyRoute(ctx *CmdContext) error {
 		IPPrefix: ctx.conf.Subnet,
 		Nexthop:  ctx.conf.Router,
 		Policy:   &nbdb.LogicalRouterStaticRoutePolicySrcIP,
+		ExternalIDs: map[string]string{
+			networkExternalIDKey: ctx.conf.Name,
+		},
 	}
 
-	p := func(item *nbdb.LogicalRouterStaticRoute) bool {
-		return item.Policy != nil && *item.Policy == *dummyRoute.Policy && item.Nexthop == dummyRoute.Nexthop && item.IPPrefix == dummyRoute.IPPrefix
-	}
-	if err := libovsdbops.CreateOrUpdateLogicalRouterStaticRoutesWithPredicate(ctx.nbcli, j.lr.Name, &dummyRoute, p); err != nil {
+	if err := t.ensureRouterStaticRoute(j.lr.Name, &dummyRoute, isDummyRoute(ctx)); err != nil {
 		return fmt.Errorf("failed ensuring dummy route: %v", err)
 	}
 	return nil
 }
 
-func (j *JoinRouter) ensureKeepInternalTrafficNextHopPolicy(ctx *CmdContext) error {
+// isDummyRoute returns true for the tenant network dummy route, the routes
+// created before they had the network are identified by the subnet
+func isDummyRoute(ctx *CmdContext) func(*nbdb.LogicalRouterStaticRoute) bool {
+	return func(item *nbdb.LogicalRouterStaticRoute) bool {
+		if item.Policy == nil || *item.Policy != nbdb.LogicalRouterStaticRoutePolicySrcIP || item.IPPrefix != ctx.conf.Subnet {
+			return false
+		}
+		network, ok := item.ExternalIDs[networkExternalIDKey]
+		return network == ctx.conf.Name || !ok
+	}
+}
+
+func (j *JoinRouter) ensureKeepInternalTrafficNextHopPolicy(ctx *CmdContext, t *nbTxn) error {
 	// Add a allow policy with higher priority to keep nexthop for e/s traffic
 	// TODO: Read the internal subnets from the system
-	podCIDR := "10.244.0.0/16"
-	internalCIDR := "100.64.0.0/16"
 	policy := nbdb.LogicalRouterPolicy{
-		Match:    fmt.Sprintf("ip4.src == %s && ip4.dst == { %s, %s }", ctx.conf.Subnet, podCIDR, internalCIDR),
+		Match:    fmt.Sprintf("ip4.src == %s && ip4.dst == { %s }", ctx.conf.Subnet, strings.Join(ctx.conf.infraSubnets(), ", ")),
 		Action:   nbdb.LogicalRouterPolicyActionAllow,
 		Priority: 2,
+		ExternalIDs: map[string]string{
+			networkExternalIDKey: ctx.conf.Name,
+		},
 	}
 
 	predicate := func(item *nbdb.LogicalRouterPolicy) bool {
-		return item.Priority == policy.Priority && item.Match == policy.Match && item.Action == policy.Action
+		if item.Priority != policy.Priority || item.Action != policy.Action {
+			return false
+		}
+		network, ok := item.ExternalIDs[networkExternalIDKey]
+		// Policies created before they had the network are identified by
+		// the match
+		return network == ctx.conf.Name || (!ok && item.Match == policy.Match)
 	}
 
-	if err := libovsdbops.CreateOrUpdateLogicalRouterPolicyWithPredicate(ctx.nbcli, j.lr.Name, &policy, predicate); err != nil {
+	if err := t.ensureRouterPolicy(j.lr.Name, &policy, predicate); err != nil {
 		return fmt.Errorf("failed ensuring policy at cluster router to keep e/w nexthop: %v", err)
 	}
 	return nil
 }
 
-func (j *JoinRouter) ensureRerouteToGwPolicy(ctx *CmdContext, lsp *nbdb.LogicalSwitchPort) error {
+// gatewayRouterJoinAddress returns the address of the node gateway router
+// port connected to the join switch
+func gatewayRouterJoinAddress(nbcli ovsclient.Client, node string) (string, error) {
 	nodeLRP := &nbdb.LogicalRouterPort{
-		Name: ovnktypes.GWRouterToJoinSwitchPrefix + ovnktypes.GWRouterPrefix + ctx.hostname,
+		Name: ovnktypes.GWRouterToJoinSwitchPrefix + ovnktypes.GWRouterPrefix + node,
 	}
 
-	nodeLRP, err := libovsdbops.GetLogicalRouterPort(ctx.nbcli, nodeLRP)
+	nodeLRP, err := libovsdbops.GetLogicalRouterPort(nbcli, nodeLRP)
 	if err != nil {
-		return err
+		return "", err
 	}
 	nodeLRPIP, _, err := net.ParseCIDR(nodeLRP.Networks[0])
 	if err != nil {
-		return err
+		return "", err
 	}
 	nodeGwAddress := nodeLRPIP.String()
 	if nodeGwAddress == "" {
-		return fmt.Errorf("missing node gw router port address")
+		return "", fmt.Errorf("missing node gw router port address")
 	}
+	return nodeGwAddress, nil
+}
 
+// logicalSwitchPortAddress returns the IP assigned to the port
+func logicalSwitchPortAddress(nbcli ovsclient.Client, lsp *nbdb.LogicalSwitchPort) (string, error) {
 	// We need to read the lsp again to get the assigned address
-	lsp, err = libovsdbops.GetLogicalSwitchPort(ctx.nbcli, lsp)
+	lsp, err := libovsdbops.GetLogicalSwitchPort(nbcli, lsp)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if lsp.DynamicAddresses == nil || *lsp.DynamicAddresses == "" || len(strings.Split(*lsp.DynamicAddresses, " ")) < 2 {
-		return fmt.Errorf("missing dynamic addresses at lsp %s", lsp.Name)
+	address := lspAddress(lsp)
+	if address == "" {
+		return "", fmt.Errorf("missing addresses at lsp %s", lsp.Name)
 	}
+	return address, nil
+}
 
-	vmAddress := strings.Split(*lsp.DynamicAddresses, " ")[1]
-
-	// Add a reroute policy to route VM n/s traffic to the node where the VM
-	// is running
-	policy := nbdb.LogicalRouterPolicy{
-		Match:    fmt.Sprintf("ip4.src == %s", vmAddress),
-		Action:   nbdb.LogicalRouterPolicyActionReroute,
-		Nexthops: []string{nodeGwAddress},
-		Priority: 1,
+func (j *JoinRouter) ensureRerouteToGwPolicy(ctx *CmdContext, t *nbTxn, vmAddress string) error {
+	nodeGwAddress, err := j.gatewayAddress(ctx, ctx.gatewayNode)
+	if err != nil {
+		return err
 	}
 
-	predicate := func(item *nbdb.LogicalRouterPolicy) bool {
-		return item.Priority == policy.Priority && item.Match == policy.Match && item.Action == policy.Action && item.Nexthops != nil && item.Nexthop == policy.Nexthop
+	// The network VMs routed with source routes, if the routing has been
+	// changed, are rerouted with policies too
+	lr, routes, err := vmSourceRoutes(ctx.nbcli, j.lr.Name, ctx.conf.Name)
+	if err != nil {
+		return err
 	}
-
-	if err := libovsdbops.CreateOrUpdateLogicalRouterPolicyWithPredicate(ctx.nbcli, j.lr.Name, &policy, predicate); err != nil {
-		return fmt.Errorf("failed ensuring policy to reroute to n/s traffic: %v", err)
+	for _, route := range routes {
+		if route.IPPrefix != vmAddress && route.ExternalIDs[portExternalIDKey] != ctx.portName {
+			if err := ensureVMReroutePolicy(t, j.lr.Name, reroutePolicy(route.ExternalIDs, route.IPPrefix, route.Nexthop)); err != nil {
+				return err
+			}
+		}
+		if err := t.remove(lr, &lr.StaticRoutes, route.UUID); err != nil {
+			return fmt.Errorf("failed removing %s source route: %v", route.IPPrefix, err)
+		}
 	}
-	return nil
+
+	// Add a reroute policy to route VM n/s traffic to the node where the VM
+	// is running or the egress node
+	return ensureVMReroutePolicy(t, j.lr.Name, reroutePolicy(vmExternalIDs(ctx), vmAddress, nodeGwAddress))
 }
 
-func masqueradeTenantSubnet(ctx *CmdContext) error {
+func masqueradeTenantSubnet(ctx *CmdContext, t *nbTxn) error {
 	currentGwLR := &nbdb.LogicalRouter{
 		Name: ovnktypes.GWRouterPrefix + ctx.hostname,
 	}
@@ -636,19 +1105,27 @@ func masqueradeTenantSubnet(ctx *CmdContext) error {
 
 	masqueradeNAT := &nbdb.NAT{
 		ExternalIP: currentGwLRPIP.String(),
-		LogicalIP:  ctx.conf.Subnet,
+		LogicalIP:  ctx.joinRouter.sourceSubnet(ctx),
 		Type:       nbdb.NATTypeSNAT,
 		Options: map[string]string{
 			"stateless": "false",
 		},
+		ExternalIDs: map[string]string{
+			networkExternalIDKey: ctx.conf.Name,
+			nodeExternalIDKey:    ctx.hostname,
+		},
+	}
+	predicate := func(item *nbdb.NAT) bool {
+		_, isEgress := item.ExternalIDs[egressNodesExternalIDKey]
+		return !isEgress && item.Type == masqueradeNAT.Type && item.ExternalIDs[networkExternalIDKey] == ctx.conf.Name
 	}
-	if err := libovsdbops.CreateOrUpdateNATs(ctx.nbcli, currentGwLR, masqueradeNAT); err != nil {
-		return fmt.Errorf("failed ensuring tenant subnet masquerade: %s")
+	if err := t.ensureRouterNAT(currentGwLR.Name, masqueradeNAT, predicate); err != nil {
+		return fmt.Errorf("failed ensuring tenant subnet masquerade: %v", err)
 	}
 	return nil
 }
 
-func routeTenantSubnetToJoinRouter(ctx *CmdContext) error {
+func routeTenantSubnetToJoinRouter(ctx *CmdContext, t *nbTxn) error {
 	joinGwPort := &nbdb.LogicalRouterPort{
 		Name: ovnktypes.GWRouterToJoinSwitchPrefix + ovnktypes.OVNClusterRouter,
 	}
@@ -663,13 +1140,11 @@ func routeTenantSubnetToJoinRouter(ctx *CmdContext) error {
 		return err
 	}
 
-	route := nbdb.LogicalRouterStaticRoute{
-		IPPrefix: ctx.conf.Subnet,
-		Nexthop:  joinGwPortIP.String(),
-	}
-
 	predicate := func(item *nbdb.LogicalRouterStaticRoute) bool {
-		return item.Nexthop == route.Nexthop && item.IPPrefix == route.IPPrefix
+		network, ok := item.ExternalIDs[networkExternalIDKey]
+		// Routes created before they had the network are identified by
+		// the subnet
+		return network == ctx.conf.Name || (!ok && item.IPPrefix == ctx.conf.Subnet && item.Nexthop == joinGwPortIP.String())
 	}
 
 	nodes, err := nodes(ctx)
@@ -678,7 +1153,15 @@ func routeTenantSubnetToJoinRouter(ctx *CmdContext) error {
 	}
 
 	for _, node := range nodes {
-		if err := libovsdbops.CreateOrUpdateLogicalRouterStaticRoutesWithPredicate(ctx.nbcli, ovnktypes.GWRouterPrefix+node.Name, &route, predicate); err != nil {
+		route := nbdb.LogicalRouterStaticRoute{
+			IPPrefix: ctx.conf.Subnet,
+			Nexthop:  joinGwPortIP.String(),
+			ExternalIDs: map[string]string{
+				networkExternalIDKey: ctx.conf.Name,
+				nodeExternalIDKey:    node.Name,
+			},
+		}
+		if err := t.ensureRouterStaticRoute(ovnktypes.GWRouterPrefix+node.Name, &route, predicate); err != nil {
 			return fmt.Errorf("failed ensuring route to join router at gw: %v", err)
 		}
 	}
@@ -686,19 +1169,41 @@ func routeTenantSubnetToJoinRouter(ctx *CmdContext) error {
 	return nil
 }
 
-func newJoinRouter() *JoinRouter {
+func newJoinRouter(ctx *CmdContext) *JoinRouter {
+	lr := &nbdb.LogicalRouter{
+		Name:    ovnktypes.OVNClusterRouter,
+		Enabled: &enabled,
+	}
+	if ctx.conf.dedicatedRouter() {
+		lr.Name = tenantRouterName(ctx.conf.Name)
+		lr.ExternalIDs = map[string]string{
+			networkExternalIDKey:         ctx.conf.Name,
+			dedicatedRouterExternalIDKey: "true",
+		}
+	}
 	return &JoinRouter{
-		lr: &nbdb.LogicalRouter{
-			Name:    ovnktypes.OVNClusterRouter,
-			Enabled: &enabled,
-		},
+		lr:          lr,
 		tenantPorts: map[string]*nbdb.LogicalRouterPort{},
 		gwPorts:     map[string]*nbdb.LogicalRouterPort{},
+		gwAddresses: map[string]string{},
 	}
 }
 
-func (j *JoinRouter) ensure(ctx *CmdContext) error {
-	if err := libovsdbops.CreateOrUpdateLogicalRouter(ctx.nbcli, j.lr); err != nil {
+// sourceSubnet returns the source of the tenant network traffic at the
+// gateway routers
+func (j *JoinRouter) sourceSubnet(ctx *CmdContext) string {
+	if j.transitPort == nil {
+		return ctx.conf.Subnet
+	}
+	ip, _, err := net.ParseCIDR(j.transitPort.Networks[0])
+	if err != nil {
+		return ctx.conf.Subnet
+	}
+	return ip.String()
+}
+
+func (j *JoinRouter) ensure(ctx *CmdContext, t *nbTxn) error {
+	if err := t.ensureRouter(j.lr); err != nil {
 		return err
 	}
 
@@ -709,48 +1214,126 @@ func (j *JoinRouter) ensure(ctx *CmdContext) error {
 	for _, p := range j.tenantPorts {
 		ports = append(ports, p)
 	}
-	if err := libovsdbops.CreateOrUpdateLogicalRouterPorts(ctx.nbcli, j.lr, ports); err != nil {
-		return err
+	for _, p := range ports {
+		if err := t.ensureRouterPort(j.lr.Name, p); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (j *JoinRouter) addTenantPort(ctx *CmdContext) {
+// gatewayAddress returns the nexthop to reach the node gateway router, the
+// ports created at the ADD transaction are not at the cache yet so their
+// addresses are kept at gwAddresses
+func (j *JoinRouter) gatewayAddress(ctx *CmdContext, node string) (string, error) {
+	if address, ok := j.gwAddresses[node]; ok {
+		return address, nil
+	}
+	return gatewayRouterAddress(ctx.nbcli, ctx.conf.Name, node)
+}
+
+func (j *JoinRouter) addTenantPort(ctx *CmdContext) error {
+	mac, err := routerPortMAC(ctx.nbcli, j.lr.Name, ctx.conf.Name, net.ParseIP(ctx.conf.Router))
+	if err != nil {
+		return err
+	}
 	j.tenantPorts[ctx.conf.Name] = &nbdb.LogicalRouterPort{
 		Name:     ctx.conf.Name,
-		MAC:      "00:00:00:00:ff:01",
+		MAC:      mac,
 		Networks: []string{ctx.conf.Router + "/24"}, // FIXME: Use bits from conf.Subnet
 		Enabled:  &enabled,
+		ExternalIDs: map[string]string{
+			networkExternalIDKey: ctx.conf.Name,
+		},
 	}
+	return nil
 }
 
-func (j *JoinRouter) addGatewayPort(ctx *CmdContext, i int, wNode *corev1.Node) *nbdb.LogicalRouterPort {
+// addGatewayPort adds the dedicated router port connected to the node
+// dedicated gateway router, with the block-th /30 subnet of the join subnet
+func (j *JoinRouter) addGatewayPort(ctx *CmdContext, block uint32, node, gwRouterName string) (*nbdb.LogicalRouterPort, error) {
+	address, _, err := gatewayJoinAddresses(ctx.conf.Gateway.joinSubnet(), block)
+	if err != nil {
+		return nil, err
+	}
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil, err
+	}
+	name := joinToGwPortName(gwRouterName)
+	mac, err := routerPortMAC(ctx.nbcli, j.lr.Name, name, ip)
+	if err != nil {
+		return nil, err
+	}
+	peer := gwToJoinPortName(gwRouterName)
 	gwPort := &nbdb.LogicalRouterPort{
-		Name:     joinToGwPortName(wNode.Name),
-		MAC:      fmt.Sprintf("00:00:21:20:12:1%d", i),
-		Networks: []string{fmt.Sprintf("10.64.0.1%d/24", i)},
+		Name:     name,
+		MAC:      mac,
+		Networks: []string{address},
+		Peer:     &peer,
 		Enabled:  &enabled,
+		ExternalIDs: map[string]string{
+			networkExternalIDKey: ctx.conf.Name,
+			nodeExternalIDKey:    node,
+		},
 	}
-	j.gwPorts[wNode.Name] = gwPort
-	return gwPort
+	j.gwPorts[gwRouterName] = gwPort
+	return gwPort, nil
 }
 
-func (g *GatewayRouter) setNodePort(ctx *CmdContext, i int, wNode *corev1.Node) {
+// setNodePort adds the gateway router port connected to the external switch
+func (g *GatewayRouter) setNodePort(ctx *CmdContext, node GatewayNodeConf) error {
+	ip, _, err := net.ParseCIDR(node.Address)
+	if err != nil {
+		return fmt.Errorf("invalid gateway address %q for node %s: %v", node.Address, node.Name, err)
+	}
+	name := ovnktypes.GWRouterToExtSwitchPrefix + g.lr.Name
+	mac, err := routerPortMAC(ctx.nbcli, g.lr.Name, name, ip)
+	if err != nil {
+		return err
+	}
 	g.gwPort = &nbdb.LogicalRouterPort{
-		Name:     wNode.Name,
-		MAC:      fmt.Sprintf("00:00:21:20:10:1%d", i),
-		Networks: []string{fmt.Sprintf("172.19.0.25%d/16", 4-i)},
+		Name:     name,
+		MAC:      mac,
+		Networks: []string{node.Address},
 		Enabled:  &enabled,
+		ExternalIDs: map[string]string{
+			networkExternalIDKey: ctx.conf.Name,
+			nodeExternalIDKey:    node.Name,
+		},
 	}
+	return nil
 }
 
-func (g *GatewayRouter) setJoinPort(ctx *CmdContext, i int, wNode *corev1.Node) {
+// setJoinPort adds the gateway router port connected to the dedicated router
+// port, with the block-th /30 subnet of the join subnet
+func (g *GatewayRouter) setJoinPort(ctx *CmdContext, block uint32, node string) error {
+	_, address, err := gatewayJoinAddresses(ctx.conf.Gateway.joinSubnet(), block)
+	if err != nil {
+		return err
+	}
+	ip, _, err := net.ParseCIDR(address)
+	if err != nil {
+		return err
+	}
+	name := gwToJoinPortName(g.lr.Name)
+	mac, err := routerPortMAC(ctx.nbcli, g.lr.Name, name, ip)
+	if err != nil {
+		return err
+	}
+	peer := joinToGwPortName(g.lr.Name)
 	g.joinPort = &nbdb.LogicalRouterPort{
-		Name:     gwToJoinPortName(wNode.Name),
-		MAC:      fmt.Sprintf("00:00:21:20:11:1%d", i),
-		Networks: []string{fmt.Sprintf("10.64.0.2%d/24", i)},
+		Name:     name,
+		MAC:      mac,
+		Networks: []string{address},
+		Peer:     &peer,
 		Enabled:  &enabled,
+		ExternalIDs: map[string]string{
+			networkExternalIDKey: ctx.conf.Name,
+			nodeExternalIDKey:    node,
+		},
 	}
+	return nil
 }
 
 func joinToGwPortName(nodeName string) string {
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	ovsclient "github.com/ovn-org/libovsdb/client"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/libovsdbops"
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+
+	k8sclient "sigs.k8s.io/controller-runtime/pkg/client"
+
+	ovnkubevirtv1alpha1 "github.com/qinqon/ovn-kubevirt/api/v1alpha1"
+)
+
+const (
+	// The explicit deny rules have precedence over the allow rules and the
+	// allow rules over the default deny
+	denyRulePriority    = 1002
+	allowRulePriority   = 1001
+	defaultDenyPriority = 1000
+
+	ingressRules = "ingress"
+	egressRules  = "egress"
+)
+
+// tenantNetworkPolicyReconciler implements the TenantNetworkPolicies with a
+// port group per policy with the ACLs of the rules
+type tenantNetworkPolicyReconciler struct {
+	k8scli k8sclient.Client
+	nbcli  ovsclient.Client
+}
+
+func (r *tenantNetworkPolicyReconciler) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	key := tenantNetworkPolicyKey(request.Namespace, request.Name)
+	tnp := &ovnkubevirtv1alpha1.TenantNetworkPolicy{}
+	if err := r.k8scli.Get(ctx, request.NamespacedName, tnp); err != nil {
+		if apierrors.IsNotFound(err) {
+			return reconcile.Result{}, deleteTenantNetworkPolicy(r.nbcli, key)
+		}
+		return reconcile.Result{}, err
+	}
+
+	ls, err := libovsdbops.GetLogicalSwitch(r.nbcli, &nbdb.LogicalSwitch{Name: tnp.Spec.Network})
+	if err != nil {
+		if errors.Is(err, ovsclient.ErrNotFound) {
+			// No VMI has been attached to the tenant network yet
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, fmt.Errorf("failed getting tenant logical switch %s: %v", tnp.Spec.Network, err)
+	}
+
+	policy := &tenantNetworkPolicy{
+		key:         key,
+		tnp:         tnp,
+		portGroup:   hashForOVN(key),
+		addressSets: []*nbdb.AddressSet{},
+	}
+
+	policy.ports, err = selectNetworkPorts(ctx, r.k8scli, r.nbcli, ls, tnp.Namespace, &tnp.Spec.VMISelector)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if err := policy.buildACLs(func(peer *ovnkubevirtv1alpha1.TenantNetworkPolicyPeer) ([]string, error) {
+		peerPorts, err := selectNetworkPorts(ctx, r.k8scli, r.nbcli, ls, tnp.Namespace, peer.VMISelector)
+		if err != nil {
+			return nil, err
+		}
+		addresses := []string{}
+		for _, port := range peerPorts {
+			addresses = append(addresses, port.address)
+		}
+		return addresses, nil
+	}); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if err := policy.ensure(r.nbcli); err != nil {
+		return reconcile.Result{}, err
+	}
+	return reconcile.Result{}, nil
+}
+
+// vmiToTenantNetworkPolicies reconciles the policies at the VMI namespace,
+// the VMI can be selected by the policy or by its peers.
+func (r *tenantNetworkPolicyReconciler) vmiToTenantNetworkPolicies(obj k8sclient.Object) []reconcile.Request {
+	tnpList := &ovnkubevirtv1alpha1.TenantNetworkPolicyList{}
+	if err := r.k8scli.List(context.Background(), tnpList, k8sclient.InNamespace(obj.GetNamespace())); err != nil {
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, tnp := range tnpList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: tnp.Namespace, Name: tnp.Name}})
+	}
+	return requests
+}
+
+func tenantNetworkPolicyKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// hashForOVN returns a name that can be used to reference port groups and
+// address sets at the ACL matches
+func hashForOVN(s string) string {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return fmt.Sprintf("a%d", h.Sum64())
+}
+
+// tenantNetworkPolicy is the OVN representation of a TenantNetworkPolicy
+type tenantNetworkPolicy struct {
+	key         string
+	tnp         *ovnkubevirtv1alpha1.TenantNetworkPolicy
+	portGroup   string
+	ports       []networkPort
+	addressSets []*nbdb.AddressSet
+	acls        []*nbdb.ACL
+}
+
+// buildACLs translates the policy rules into ACLs, the peers VMIs addresses
+// are returned by peerAddresses
+func (p *tenantNetworkPolicy) buildACLs(peerAddresses func(peer *ovnkubevirtv1alpha1.TenantNetworkPolicyPeer) ([]string, error)) error {
+	for _, direction := range []string{ingressRules, egressRules} {
+		rules := p.tnp.Spec.Ingress
+		if direction == egressRules {
+			rules = p.tnp.Spec.Egress
+		}
+		for i, rule := range rules {
+			ruleName := fmt.Sprintf("%s:%d", direction, i)
+			peers := []string{}
+			for j, peer := range rule.Peers {
+				if peer.CIDR != "" {
+					if _, _, err := net.ParseCIDR(peer.CIDR); err != nil && net.ParseIP(peer.CIDR) == nil {
+						return fmt.Errorf("invalid %s peer cidr %q", ruleName, peer.CIDR)
+					}
+					peers = append(peers, peer.CIDR)
+				}
+				if peer.VMISelector != nil {
+					addresses, err := peerAddresses(&peer)
+					if err != nil {
+						return err
+					}
+					as := &nbdb.AddressSet{
+						Name:      hashForOVN(fmt.Sprintf("%s/%s:%d", p.key, ruleName, j)),
+						Addresses: addresses,
+						ExternalIDs: map[string]string{
+							networkExternalIDKey:       p.tnp.Spec.Network,
+							networkPolicyExternalIDKey: p.key,
+						},
+					}
+					p.addressSets = append(p.addressSets, as)
+					peers = append(peers, "$"+as.Name)
+				}
+			}
+			if len(rule.Peers) > 0 && len(peers) == 0 {
+				return fmt.Errorf("%s peers need a cidr or a vmi selector", ruleName)
+			}
+
+			action, priority := nbdb.ACLActionAllowRelated, allowRulePriority
+			if rule.Action == ovnkubevirtv1alpha1.RuleActionDeny {
+				action, priority = nbdb.ACLActionDrop, denyRulePriority
+			}
+			p.acls = append(p.acls, p.buildACL(ruleName, direction, priority, p.ruleMatch(direction, peers, rule.Ports), action))
+		}
+	}
+
+	if p.tnp.Spec.DefaultDeny {
+		p.acls = append(p.acls,
+			p.buildACL("default-deny:ingress", ingressRules, defaultDenyPriority, p.ruleMatch(ingressRules, nil, nil), nbdb.ACLActionDrop),
+			p.buildACL("default-deny:egress", egressRules, defaultDenyPriority, p.ruleMatch(egressRules, nil, nil), nbdb.ACLActionDrop),
+			// The VMIs need DHCP to get their address
+			p.buildACL("allow-dhcp", egressRules, allowRulePriority, fmt.Sprintf("inport == @%s && udp.src == 68 && udp.dst == 67", p.portGroup), nbdb.ACLActionAllow),
+		)
+	}
+	return nil
+}
+
+func (p *tenantNetworkPolicy) buildACL(rule, direction string, priority int, match string, action nbdb.ACLAction) *nbdb.ACL {
+	aclDirection := nbdb.ACLDirectionToLport
+	if direction == egressRules {
+		aclDirection = nbdb.ACLDirectionFromLport
+	}
+	severity := string(p.tnp.Spec.Severity)
+	if p.tnp.Spec.Log && severity == "" {
+		severity = nbdb.ACLSeverityInfo
+	}
+	return libovsdbops.BuildACL(
+		fmt.Sprintf("%s_%s_%s", p.tnp.Namespace, p.tnp.Name, rule),
+		aclDirection,
+		priority,
+		match,
+		action,
+		"",
+		severity,
+		p.tnp.Spec.Log,
+		map[string]string{
+			networkExternalIDKey:           p.tnp.Spec.Network,
+			networkPolicyExternalIDKey:     p.key,
+			networkPolicyRuleExternalIDKey: rule,
+		},
+		nil,
+	)
+}
+
+// ruleMatch matches the traffic to the policy VMIs for ingress rules or
+// from them for egress rules
+func (p *tenantNetworkPolicy) ruleMatch(direction string, peers []string, ports []ovnkubevirtv1alpha1.TenantNetworkPolicyPort) string {
+	match := []string{}
+	if direction == ingressRules {
+		match = append(match, fmt.Sprintf("outport == @%s", p.portGroup))
+	} else {
+		match = append(match, fmt.Sprintf("inport == @%s", p.portGroup))
+	}
+	match = append(match, "ip4")
+	if len(peers) > 0 {
+		field := "ip4.src"
+		if direction == egressRules {
+			field = "ip4.dst"
+		}
+		match = append(match, fmt.Sprintf("%s == {%s}", field, strings.Join(peers, ", ")))
+	}
+	if len(ports) > 0 {
+		portsMatch := []string{}
+		for _, port := range ports {
+			protocol := loadBalancerProtocol(port.Protocol)
+			switch {
+			case port.Port == 0:
+				portsMatch = append(portsMatch, protocol)
+			case port.EndPort > port.Port:
+				portsMatch = append(portsMatch, fmt.Sprintf("%[1]s.dst >= %[2]d && %[1]s.dst <= %[3]d", protocol, port.Port, port.EndPort))
+			default:
+				portsMatch = append(portsMatch, fmt.Sprintf("%s.dst == %d", protocol, port.Port))
+			}
+		}
+		match = append(match, fmt.Sprintf("(%s)", strings.Join(portsMatch, " || ")))
+	}
+	return strings.Join(match, " && ")
+}
+
+// ensure configures the address sets and the port group with the ACLs at a
+// single transaction, so a policy is never half applied. The ACLs no longer
+// referenced by the port group are garbage collected.
+func (p *tenantNetworkPolicy) ensure(nbcli ovsclient.Client) error {
+	t := newNBTxn(nbcli)
+	desired := map[string]bool{}
+	for _, as := range p.addressSets {
+		if err := t.ensureAddressSet(as); err != nil {
+			return fmt.Errorf("failed ensuring network policy %s address sets: %v", p.key, err)
+		}
+		desired[as.Name] = true
+	}
+
+	// Remove the address sets of the peers no longer configured
+	stale, err := libovsdbops.FindAddressSetsWithPredicate(nbcli, func(item *nbdb.AddressSet) bool {
+		return item.ExternalIDs[networkPolicyExternalIDKey] == p.key && !desired[item.Name]
+	})
+	if err != nil {
+		return fmt.Errorf("failed looking for network policy %s stale address sets: %v", p.key, err)
+	}
+	for _, as := range stale {
+		if err := t.delete(as); err != nil {
+			return fmt.Errorf("failed removing network policy %s stale address set %s: %v", p.key, as.Name, err)
+		}
+	}
+
+	t.ops, err = libovsdbops.CreateOrUpdateACLsOps(nbcli, t.ops, p.acls...)
+	if err != nil {
+		return fmt.Errorf("failed ensuring network policy %s acls: %v", p.key, err)
+	}
+
+	lsps := []*nbdb.LogicalSwitchPort{}
+	for _, port := range p.ports {
+		lsps = append(lsps, port.lsp)
+	}
+	pg := libovsdbops.BuildPortGroup(p.portGroup, p.key, lsps, p.acls)
+	pg.ExternalIDs[networkExternalIDKey] = p.tnp.Spec.Network
+	pg.ExternalIDs[networkPolicyExternalIDKey] = p.key
+	t.ops, err = libovsdbops.CreateOrUpdatePortGroupsOps(nbcli, t.ops, pg)
+	if err != nil {
+		return fmt.Errorf("failed ensuring network policy %s port group: %v", p.key, err)
+	}
+
+	if err := t.commit(); err != nil {
+		return fmt.Errorf("failed ensuring network policy %s: %v", p.key, err)
+	}
+	return nil
+}
+
+// deleteTenantNetworkPolicy removes the port group, its ACLs are garbage
+// collected, and the address sets
+func deleteTenantNetworkPolicy(nbcli ovsclient.Client, key string) error {
+	if err := libovsdbops.DeletePortGroups(nbcli, hashForOVN(key)); err != nil {
+		return fmt.Errorf("failed deleting network policy %s port group: %v", key, err)
+	}
+	if err := libovsdbops.DeleteAddressSetsWithPredicate(nbcli, func(item *nbdb.AddressSet) bool {
+		return item.ExternalIDs[networkPolicyExternalIDKey] == key
+	}); err != nil {
+		return fmt.Errorf("failed deleting network policy %s address sets: %v", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	ovsclient "github.com/ovn-org/libovsdb/client"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/libovsdbops"
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+	libovsdbtest "github.com/ovn-org/ovn-kubernetes/go-controller/pkg/testing/libovsdb"
+
+	ovnkubevirtv1alpha1 "github.com/qinqon/ovn-kubevirt/api/v1alpha1"
+)
+
+func TestEnsureTenantNetworkPolicy(t *testing.T) {
+	const key = "ns1/policy1"
+	peer := ovnkubevirtv1alpha1.TenantNetworkPolicyPeer{VMISelector: &metav1.LabelSelector{}}
+	ensure := func(t *testing.T, nbcli ovsclient.Client, addresses []string, peers ...ovnkubevirtv1alpha1.TenantNetworkPolicyPeer) error {
+		policy := &tenantNetworkPolicy{
+			key: key,
+			tnp: &ovnkubevirtv1alpha1.TenantNetworkPolicy{
+				Spec: ovnkubevirtv1alpha1.TenantNetworkPolicySpec{
+					Network: "net1",
+					Ingress: []ovnkubevirtv1alpha1.TenantNetworkPolicyRule{{Peers: peers}},
+				},
+			},
+			portGroup:   hashForOVN(key),
+			addressSets: []*nbdb.AddressSet{},
+		}
+		if err := policy.buildACLs(func(*ovnkubevirtv1alpha1.TenantNetworkPolicyPeer) ([]string, error) {
+			return addresses, nil
+		}); err != nil {
+			t.Fatalf("failed building acls: %v", err)
+		}
+		return policy.ensure(nbcli)
+	}
+	addressSets := func(t *testing.T, nbcli ovsclient.Client) []*nbdb.AddressSet {
+		ass, err := libovsdbops.FindAddressSetsWithPredicate(nbcli, func(item *nbdb.AddressSet) bool {
+			return item.ExternalIDs[networkPolicyExternalIDKey] == key
+		})
+		if err != nil {
+			t.Fatalf("failed listing address sets: %v", err)
+		}
+		return ass
+	}
+
+	nbcli, cleanup, err := libovsdbtest.NewNBTestHarness(libovsdbtest.TestSetup{}, nil)
+	if err != nil {
+		t.Fatalf("failed creating NB test harness: %v", err)
+	}
+	defer cleanup.Cleanup()
+
+	// The address sets are created, updated and removed with the ACLs
+	for _, addresses := range [][]string{{"192.168.10.2"}, {"192.168.10.2", "192.168.10.3"}} {
+		if err := ensure(t, nbcli, addresses, peer); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ass := addressSets(t, nbcli); len(ass) != 1 || len(ass[0].Addresses) != len(addresses) {
+			t.Fatalf("expected one address set with %v, got %d", addresses, len(ass))
+		}
+	}
+	if err := ensure(t, nbcli, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ass := addressSets(t, nbcli); len(ass) != 0 {
+		t.Errorf("expected the stale address sets to be removed, got %d", len(ass))
+	}
+	pgs, err := libovsdbops.FindPortGroupsWithPredicate(nbcli, func(item *nbdb.PortGroup) bool {
+		return item.Name == hashForOVN(key)
+	})
+	if err != nil {
+		t.Fatalf("failed looking for port group: %v", err)
+	}
+	if len(pgs) != 1 || len(pgs[0].ACLs) == 0 {
+		t.Errorf("expected the port group with the ACLs")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	ovsclient "github.com/ovn-org/libovsdb/client"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/libovsdbops"
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+
+	k8sclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// networkPort is the port of a VMI attached to a tenant network
+type networkPort struct {
+	lsp     *nbdb.LogicalSwitchPort
+	address string
+}
+
+// selectNetworkPorts returns the ports, sorted by address, of the VMIs at
+// the namespace matching the selector that are attached to the tenant
+// logical switch
+func selectNetworkPorts(ctx context.Context, k8scli k8sclient.Client, nbcli ovsclient.Client, ls *nbdb.LogicalSwitch, namespace string, labelSelector *metav1.LabelSelector) ([]networkPort, error) {
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector: %v", err)
+	}
+	vmiList := &kubevirtv1.VirtualMachineInstanceList{}
+	if err := k8scli.List(ctx, vmiList, k8sclient.InNamespace(namespace), k8sclient.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, fmt.Errorf("failed listing vmis: %v", err)
+	}
+	ports := []networkPort{}
+	for i := range vmiList.Items {
+		lsps, err := vmiSwitchPorts(nbcli, ls, &vmiList.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		for j := range lsps {
+			lsp := &lsps[j]
+			address := lspAddress(lsp)
+			if address == "" {
+				return nil, fmt.Errorf("missing addresses at lsp %s", lsp.Name)
+			}
+			ports = append(ports, networkPort{lsp: lsp, address: address})
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].address < ports[j].address })
+	return ports, nil
+}
+
+// vmiSwitchPorts returns the switch ports, sorted by name, of the VMI
+// interfaces attached to the tenant logical switch
+func vmiSwitchPorts(nbcli ovsclient.Client, ls *nbdb.LogicalSwitch, vmi *kubevirtv1.VirtualMachineInstance) ([]nbdb.LogicalSwitchPort, error) {
+	key := vmiKey(vmi)
+	legacyName := legacyPortName(vmi.Namespace, vmi.Name)
+	lsps := []nbdb.LogicalSwitchPort{}
+	if err := nbcli.WhereCache(func(item *nbdb.LogicalSwitchPort) bool {
+		return containsString(ls.Ports, item.UUID) && (item.ExternalIDs[vmiExternalIDKey] == key || item.Name == legacyName)
+	}).List(context.Background(), &lsps); err != nil {
+		return nil, fmt.Errorf("failed listing vmi %s ports at switch %s: %v", key, ls.Name, err)
+	}
+	sort.Slice(lsps, func(i, j int) bool { return lsps[i].Name < lsps[j].Name })
+	return lsps, nil
+}
+
+// legacySwitchPort returns the VMI switch port created before it had the
+// network and the interface at the name, if it's at the tenant logical switch
+func legacySwitchPort(nbcli ovsclient.Client, ls *nbdb.LogicalSwitch, vmi *kubevirtv1.VirtualMachineInstance) (*nbdb.LogicalSwitchPort, error) {
+	if ls == nil {
+		return nil, nil
+	}
+	lsp, err := libovsdbops.GetLogicalSwitchPort(nbcli, &nbdb.LogicalSwitchPort{Name: legacyPortName(vmi.Namespace, vmi.Name)})
+	if errors.Is(err, ovsclient.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed getting legacy switch port: %v", err)
+	}
+	if !containsString(ls.Ports, lsp.UUID) {
+		return nil, nil
+	}
+	return lsp, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/libovsdbops"
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+)
+
+// checkSubnetOverlap refuses tenant subnets overlapping with the infra
+// cluster subnets or other tenant subnets if they are routed by the shared
+// cluster router and gateway routers, the networks with a dedicated router
+// can overlap since they are masqueraded at their own router, and the layer2
+// networks since they are not routed.
+func checkSubnetOverlap(ctx *CmdContext) error {
+	_, subnet, err := net.ParseCIDR(ctx.conf.Subnet)
+	if err != nil {
+		return fmt.Errorf("invalid tenant subnet %q: %v", ctx.conf.Subnet, err)
+	}
+
+	// The subnets of dedicated routers and layer2 networks are not routed
+	// by ovn_cluster_router
+	if ctx.conf.dedicatedRouter() || ctx.conf.topology() == layer2Topology {
+		return nil
+	}
+
+	infraSubnets := append(append([]string{}, ctx.conf.infraSubnets()...), ctx.conf.serviceSubnets()...)
+	for _, infraSubnet := range infraSubnets {
+		_, infra, err := net.ParseCIDR(infraSubnet)
+		if err != nil {
+			return fmt.Errorf("invalid infra subnet %q: %v", infraSubnet, err)
+		}
+		if subnetsOverlap(subnet, infra) {
+			return fmt.Errorf("tenant subnet %s overlaps with infra subnet %s, a dedicated router is needed", subnet, infra)
+		}
+	}
+
+	switches, err := libovsdbops.FindLogicalSwitchesWithPredicate(ctx.nbcli, func(item *nbdb.LogicalSwitch) bool {
+		network := switchNetwork(item)
+		return network != "" && network != ctx.conf.Name && !isLayer2Switch(item)
+	})
+	if err != nil {
+		return fmt.Errorf("failed looking for tenant switches: %v", err)
+	}
+	for _, ls := range switches {
+		_, other, err := net.ParseCIDR(ls.OtherConfig["subnet"])
+		if err != nil || !subnetsOverlap(subnet, other) {
+			continue
+		}
+		network := switchNetwork(ls)
+		dedicated, err := isDedicatedRouterNetwork(ctx.nbcli, network)
+		if err != nil {
+			return err
+		}
+		if !dedicated {
+			return fmt.Errorf("tenant subnet %s overlaps with network %s subnet %s, both networks need a dedicated router", subnet, network, other)
+		}
+	}
+	return nil
+}
+
+func subnetsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// switchNetwork returns the tenant network of the switch, the tenant switches
+// created before they had the network key are named after it and have a
+// subnet. The infra node switches have a subnet too but it's at the infra
+// subnets so a tenant subnet overlapping with them is already refused.
+func switchNetwork(ls *nbdb.LogicalSwitch) string {
+	if network, ok := ls.ExternalIDs[networkExternalIDKey]; ok {
+		return network
+	}
+	if ls.OtherConfig["subnet"] == "" {
+		return ""
+	}
+	return ls.Name
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+	libovsdbtest "github.com/ovn-org/ovn-kubernetes/go-controller/pkg/testing/libovsdb"
+)
+
+func TestCheckSubnetOverlap(t *testing.T) {
+	tenantSwitch := func(network, subnet string, externalIDs map[string]string) *nbdb.LogicalSwitch {
+		ls := &nbdb.LogicalSwitch{
+			UUID:        network + "-uuid",
+			Name:        network,
+			OtherConfig: map[string]string{"subnet": subnet},
+			ExternalIDs: map[string]string{networkExternalIDKey: network},
+		}
+		for key, value := range externalIDs {
+			ls.ExternalIDs[key] = value
+		}
+		return ls
+	}
+	legacySwitch := func(network, subnet string) *nbdb.LogicalSwitch {
+		return &nbdb.LogicalSwitch{
+			UUID:        network + "-uuid",
+			Name:        network,
+			OtherConfig: map[string]string{"subnet": subnet},
+		}
+	}
+	dedicatedRouter := func(network string) *nbdb.LogicalRouter {
+		return &nbdb.LogicalRouter{
+			UUID: network + "-router-uuid",
+			Name: tenantRouterName(network),
+			ExternalIDs: map[string]string{
+				networkExternalIDKey:         network,
+				dedicatedRouterExternalIDKey: "true",
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		conf    PluginConf
+		nbData  []libovsdbtest.TestData
+		wantErr bool
+	}{
+		{
+			name: "no other networks",
+			conf: PluginConf{Subnet: "192.168.10.0/24"},
+		},
+		{
+			name:    "overlaps with infra subnet",
+			conf:    PluginConf{Subnet: "10.244.1.0/24"},
+			wantErr: true,
+		},
+		{
+			name:    "overlaps with service subnet",
+			conf:    PluginConf{Subnet: "10.96.0.0/24"},
+			wantErr: true,
+		},
+		{
+			name: "overlaps with infra subnet with dedicated router",
+			conf: PluginConf{Subnet: "10.244.1.0/24", DedicatedRouter: true},
+		},
+		{
+			name:    "overlaps with tenant network",
+			conf:    PluginConf{Subnet: "192.168.10.0/24"},
+			nbData:  []libovsdbtest.TestData{tenantSwitch("other", "192.168.0.0/16", nil)},
+			wantErr: true,
+		},
+		{
+			name:   "does not overlap with tenant network",
+			conf:   PluginConf{Subnet: "192.168.10.0/24"},
+			nbData: []libovsdbtest.TestData{tenantSwitch("other", "192.168.20.0/24", nil)},
+		},
+		{
+			name:   "same network",
+			conf:   PluginConf{Subnet: "192.168.10.0/24"},
+			nbData: []libovsdbtest.TestData{tenantSwitch("net1", "192.168.10.0/24", nil)},
+		},
+		{
+			name: "overlaps with tenant network with dedicated router",
+			conf: PluginConf{Subnet: "192.168.10.0/24"},
+			nbData: []libovsdbtest.TestData{
+				tenantSwitch("other", "192.168.10.0/24", nil),
+				dedicatedRouter("other"),
+			},
+		},
+		{
+			name: "overlaps with layer2 network",
+			conf: PluginConf{Subnet: "192.168.10.0/24"},
+			nbData: []libovsdbtest.TestData{
+				tenantSwitch("other", "192.168.10.0/24", map[string]string{topologyExternalIDKey: layer2Topology}),
+			},
+		},
+		{
+			name:    "overlaps with legacy tenant network",
+			conf:    PluginConf{Subnet: "192.168.10.0/24"},
+			nbData:  []libovsdbtest.TestData{legacySwitch("other", "192.168.10.0/24")},
+			wantErr: true,
+		},
+		{
+			name: "overlaps with legacy tenant network with dedicated router",
+			conf: PluginConf{Subnet: "192.168.10.0/24"},
+			nbData: []libovsdbtest.TestData{
+				legacySwitch("other", "192.168.10.0/24"),
+				dedicatedRouter("other"),
+			},
+		},
+		{
+			name:   "same legacy network",
+			conf:   PluginConf{Subnet: "192.168.10.0/24"},
+			nbData: []libovsdbtest.TestData{legacySwitch("net1", "192.168.10.0/24")},
+		},
+		{
+			name: "switch without subnet",
+			conf: PluginConf{Subnet: "192.168.10.0/24"},
+			nbData: []libovsdbtest.TestData{
+				&nbdb.LogicalSwitch{UUID: "join-uuid", Name: "join"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nbcli, cleanup, err := libovsdbtest.NewNBTestHarness(libovsdbtest.TestSetup{NBData: tt.nbData}, nil)
+			if err != nil {
+				t.Fatalf("failed creating NB test harness: %v", err)
+			}
+			defer cleanup.Cleanup()
+
+			conf := tt.conf
+			conf.Name = "net1"
+			err = checkSubnetOverlap(&CmdContext{nbcli: nbcli, conf: &conf})
+			if tt.wantErr && err == nil {
+				t.Errorf("expected overlap error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	ovsclient "github.com/ovn-org/libovsdb/client"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/libovsdbops"
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+)
+
+const (
+	// policyRouting reroutes the VM n/s traffic with a policy per VM, a
+	// dummy src-ip route of the tenant subnet makes the router evaluate
+	// them
+	policyRouting = "policy"
+	// sourceRouting routes the VM n/s traffic with a src-ip static route per
+	// VM, it needs a dedicated router since the VM routes take precedence
+	// over the routes of the router ports
+	sourceRouting = "source-route"
+)
+
+// vmExternalIDs returns the external ids of the VM reroute policy or source
+// route, the routing conversions keep the ones of the converted object
+func vmExternalIDs(ctx *CmdContext) map[string]string {
+	externalIDs := ctx.ownerExternalIDs()
+	externalIDs[networkExternalIDKey] = ctx.conf.Name
+	externalIDs[portExternalIDKey] = ctx.portName
+	externalIDs[gatewayNodeExternalIDKey] = ctx.gatewayNode
+	return externalIDs
+}
+
+func reroutePolicy(externalIDs map[string]string, vmAddress, nexthop string) *nbdb.LogicalRouterPolicy {
+	return &nbdb.LogicalRouterPolicy{
+		Match:       fmt.Sprintf("ip4.src == %s", vmAddress),
+		Action:      nbdb.LogicalRouterPolicyActionReroute,
+		Nexthops:    []string{nexthop},
+		Priority:    1,
+		ExternalIDs: externalIDs,
+	}
+}
+
+// ensureVMReroutePolicy creates or updates the VM reroute policy, the VMI
+// interface policy is the one with its port, the rest of policies with the
+// same source address are stale, from a former VMI or created before they
+// had the port, and are collapsed into it
+func ensureVMReroutePolicy(t *nbTxn, routerName string, policy *nbdb.LogicalRouterPolicy) error {
+	predicate := func(item *nbdb.LogicalRouterPolicy) bool {
+		if item.Action != policy.Action || item.ExternalIDs[networkExternalIDKey] != policy.ExternalIDs[networkExternalIDKey] {
+			return false
+		}
+		return isVMOwner(item.ExternalIDs, policy.ExternalIDs) || item.Match == policy.Match
+	}
+	if err := t.ensureRouterPolicy(routerName, policy, predicate); err != nil {
+		return fmt.Errorf("failed ensuring policy to reroute to n/s traffic: %v", err)
+	}
+	return nil
+}
+
+// isVMOwner returns true if the existing VM policy or route external ids have
+// the same port as the owner ones, the ones created before they had the port
+// are identified by the VMI
+func isVMOwner(existing, owner map[string]string) bool {
+	if port, ok := existing[portExternalIDKey]; ok {
+		return owner[portExternalIDKey] != "" && port == owner[portExternalIDKey]
+	}
+	vmi, ok := existing[vmiExternalIDKey]
+	return ok && vmi == owner[vmiExternalIDKey]
+}
+
+func vmSourceRoute(externalIDs map[string]string, vmAddress, nexthop string) *nbdb.LogicalRouterStaticRoute {
+	return &nbdb.LogicalRouterStaticRoute{
+		IPPrefix:    vmAddress,
+		Nexthop:     nexthop,
+		Policy:      &nbdb.LogicalRouterStaticRoutePolicySrcIP,
+		ExternalIDs: externalIDs,
+	}
+}
+
+// ensureVMSourceRoute creates or updates the VM src-ip route, collapsing the
+// routes with the same source address like the reroute policies
+func ensureVMSourceRoute(t *nbTxn, routerName string, route *nbdb.LogicalRouterStaticRoute) error {
+	predicate := func(item *nbdb.LogicalRouterStaticRoute) bool {
+		if !isVMSourceRoute(item, route.ExternalIDs[networkExternalIDKey]) {
+			return false
+		}
+		return isVMOwner(item.ExternalIDs, route.ExternalIDs) || item.IPPrefix == route.IPPrefix
+	}
+	if err := t.ensureRouterStaticRoute(routerName, route, predicate); err != nil {
+		return fmt.Errorf("failed ensuring route to n/s traffic: %v", err)
+	}
+	return nil
+}
+
+// isVMSourceRoute returns true for the src-ip routes of the network VMs, they
+// are the ones with a host address instead of the dummy route subnet
+func isVMSourceRoute(item *nbdb.LogicalRouterStaticRoute, network string) bool {
+	return item.Policy != nil && *item.Policy == nbdb.LogicalRouterStaticRoutePolicySrcIP &&
+		item.ExternalIDs[networkExternalIDKey] == network && !strings.Contains(item.IPPrefix, "/")
+}
+
+// vmSourceRoutes returns the router and its network VMs src-ip routes
+func vmSourceRoutes(nbcli ovsclient.Client, routerName, network string) (*nbdb.LogicalRouter, []*nbdb.LogicalRouterStaticRoute, error) {
+	lr, err := findRouter(nbcli, routerName)
+	if err != nil || lr == nil {
+		return nil, nil, err
+	}
+	routes, err := libovsdbops.FindLogicalRouterStaticRoutesWithPredicate(nbcli, func(item *nbdb.LogicalRouterStaticRoute) bool {
+		return containsString(lr.StaticRoutes, item.UUID) && isVMSourceRoute(item, network)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed looking for router %s source routes: %v", routerName, err)
+	}
+	return lr, routes, nil
+}
+
+// vmReroutePolicies returns the router and its network VMs reroute policies
+func vmReroutePolicies(nbcli ovsclient.Client, routerName, network string) (*nbdb.LogicalRouter, []*nbdb.LogicalRouterPolicy, error) {
+	lr, err := findRouter(nbcli, routerName)
+	if err != nil || lr == nil {
+		return nil, nil, err
+	}
+	policies, err := libovsdbops.FindLogicalRouterPoliciesWithPredicate(nbcli, func(item *nbdb.LogicalRouterPolicy) bool {
+		return containsString(lr.Policies, item.UUID) && item.Action == nbdb.LogicalRouterPolicyActionReroute &&
+			item.ExternalIDs[networkExternalIDKey] == network
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed looking for router %s reroute policies: %v", routerName, err)
+	}
+	return lr, policies, nil
+}
+
+// ensureSourceRoutes routes the VM n/s traffic to the node where the VM is
+// running, or the egress node, with a src-ip route instead of a policy. The
+// network VMs rerouted with policies, if the routing has been changed, are
+// routed with source routes too and the dummy route is removed, so there are
+// no policies involved at the tenant traffic routing.
+func (j *JoinRouter) ensureSourceRoutes(ctx *CmdContext, t *nbTxn, vmAddress string) error {
+	nodeGwAddress, err := j.gatewayAddress(ctx, ctx.gatewayNode)
+	if err != nil {
+		return err
+	}
+
+	lr, policies, err := vmReroutePolicies(ctx.nbcli, j.lr.Name, ctx.conf.Name)
+	if err != nil {
+		return err
+	}
+	for _, policy := range policies {
+		address := strings.TrimPrefix(policy.Match, "ip4.src == ")
+		if address != vmAddress && policy.ExternalIDs[portExternalIDKey] != ctx.portName && len(policy.Nexthops) > 0 {
+			if err := ensureVMSourceRoute(t, j.lr.Name, vmSourceRoute(policy.ExternalIDs, address, policy.Nexthops[0])); err != nil {
+				return err
+			}
+		}
+		if err := t.remove(lr, &lr.Policies, policy.UUID); err != nil {
+			return fmt.Errorf("failed removing %q reroute policy: %v", policy.Match, err)
+		}
+	}
+
+	if err := ensureVMSourceRoute(t, j.lr.Name, vmSourceRoute(vmExternalIDs(ctx), vmAddress, nodeGwAddress)); err != nil {
+		return err
+	}
+
+	if err := t.deleteRouterStaticRoutes(j.lr.Name, isDummyRoute(ctx)); err != nil {
+		return fmt.Errorf("failed removing dummy route: %v", err)
+	}
+	return nil
+}
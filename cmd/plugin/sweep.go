@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	ovsclient "github.com/ovn-org/libovsdb/client"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+
+	k8sclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// runSweep removes the NB objects owned by the plugin that belong to VMIs,
+// pods or nodes that no longer exist, they are left behind since the CNI DEL doesn't
+// clean up and a failed CNI ADD can be retried with a different address.
+func runSweep(args []string) error {
+	flags := flag.NewFlagSet("sweep", flag.ExitOnError)
+	kubeconfig := flags.String("kubeconfig", "", "path to the kubeconfig, in-cluster config is used if empty")
+	dryRun := flags.Bool("dry-run", false, "print the orphan objects without deleting them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	restCfg, err := restConfig(*kubeconfig)
+	if err != nil {
+		return fmt.Errorf("failed loading kubeconfig: %v", err)
+	}
+	k8scli, err := k8sclient.New(restCfg, k8sclient.Options{Scheme: pluginscheme})
+	if err != nil {
+		return err
+	}
+	nbcli, err := newNBClient(k8scli)
+	if err != nil {
+		return fmt.Errorf("failed connecting to nb database: %v", err)
+	}
+	defer nbcli.Close()
+
+	return sweep(context.Background(), k8scli, nbcli, *dryRun)
+}
+
+// sweeper has the VMIs, pods and nodes that keep their NB objects
+type sweeper struct {
+	vmis  map[string]bool
+	pods  map[string]bool
+	nodes map[string]bool
+	// addresses are the VM addresses of the kept switch ports by network
+	addresses map[string]map[string]bool
+}
+
+func sweep(ctx context.Context, k8scli k8sclient.Client, nbcli ovsclient.Client, dryRun bool) error {
+	s, err := newSweeper(ctx, k8scli)
+	if err != nil {
+		return err
+	}
+
+	t := newNBTxn(nbcli)
+	orphans := []string{}
+	if err := s.sweepSwitchPorts(t, &orphans); err != nil {
+		return err
+	}
+	if err := s.sweepRouters(t, &orphans); err != nil {
+		return err
+	}
+
+	for _, orphan := range orphans {
+		if dryRun {
+			log.Printf("would delete %s", orphan)
+		} else {
+			log.Printf("deleting %s", orphan)
+		}
+	}
+	if dryRun {
+		return nil
+	}
+	if err := t.commit(); err != nil {
+		return fmt.Errorf("failed deleting orphan objects: %v", err)
+	}
+	return nil
+}
+
+// newSweeper reads the VMIs, the pods and the nodes, a VMI is kept while it or
+// one of its virt-launcher pods exists
+func newSweeper(ctx context.Context, k8scli k8sclient.Client) (*sweeper, error) {
+	s := &sweeper{
+		vmis:      map[string]bool{},
+		pods:      map[string]bool{},
+		nodes:     map[string]bool{},
+		addresses: map[string]map[string]bool{},
+	}
+
+	vmiList := &kubevirtv1.VirtualMachineInstanceList{}
+	if err := k8scli.List(ctx, vmiList); err != nil {
+		return nil, fmt.Errorf("failed listing vmis: %v", err)
+	}
+	for i := range vmiList.Items {
+		s.vmis[vmiKey(&vmiList.Items[i])] = true
+	}
+
+	podList := &corev1.PodList{}
+	if err := k8scli.List(ctx, podList); err != nil {
+		return nil, fmt.Errorf("failed listing pods: %v", err)
+	}
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		s.pods[podKey(pod)] = true
+		if vmName, ok := pod.Labels["vm.kubevirt.io/name"]; ok {
+			s.vmis[pod.Namespace+"/"+vmName] = true
+		}
+	}
+
+	nodeList := &corev1.NodeList{}
+	if err := k8scli.List(ctx, nodeList); err != nil {
+		return nil, fmt.Errorf("failed listing nodes: %v", err)
+	}
+	for _, node := range nodeList.Items {
+		s.nodes[node.Name] = true
+	}
+	return s, nil
+}
+
+// portOwner returns the external ids of the VMI or pod of a tenant switch
+// port, the ports created before they had the VMI are identified by the port
+// name. It returns nil for the ports that are not owned by a VMI or pod.
+func portOwner(lsp *nbdb.LogicalSwitchPort) map[string]string {
+	if _, ok := lsp.ExternalIDs[vmiExternalIDKey]; ok {
+		return lsp.ExternalIDs
+	}
+	if _, ok := lsp.ExternalIDs[podExternalIDKey]; ok {
+		return lsp.ExternalIDs
+	}
+	if lsp.Type != "" {
+		return nil
+	}
+	// Namespaces cannot contain "_" so the first one splits the name
+	namespace, name, ok := strings.Cut(lsp.Name, "_")
+	if !ok {
+		return nil
+	}
+	return map[string]string{vmiExternalIDKey: namespace + "/" + name}
+}
+
+// isOrphanOwner returns if the VMI or pod at the external ids is gone, and
+// false at owned if they have none of them
+func (s *sweeper) isOrphanOwner(externalIDs map[string]string) (orphan, owned bool) {
+	if vmi, ok := externalIDs[vmiExternalIDKey]; ok {
+		return !s.vmis[vmi], true
+	}
+	if pod, ok := externalIDs[podExternalIDKey]; ok {
+		return !s.pods[pod], true
+	}
+	return false, false
+}
+
+// sweepSwitchPorts removes the tenant switches ports of VMIs or pods that are gone
+// and records the addresses of the kept ones
+func (s *sweeper) sweepSwitchPorts(t *nbTxn, orphans *[]string) error {
+	switches := []nbdb.LogicalSwitch{}
+	if err := t.nbcli.WhereCache(func(item *nbdb.LogicalSwitch) bool {
+		_, ok := item.ExternalIDs[networkExternalIDKey]
+		return ok
+	}).List(context.Background(), &switches); err != nil {
+		return fmt.Errorf("failed listing tenant switches: %v", err)
+	}
+	for i := range switches {
+		ls := &switches[i]
+		network := ls.ExternalIDs[networkExternalIDKey]
+		if s.addresses[network] == nil {
+			s.addresses[network] = map[string]bool{}
+		}
+		lsps := []nbdb.LogicalSwitchPort{}
+		if err := t.nbcli.WhereCache(func(item *nbdb.LogicalSwitchPort) bool {
+			return containsString(ls.Ports, item.UUID)
+		}).List(context.Background(), &lsps); err != nil {
+			return fmt.Errorf("failed listing switch %s ports: %v", ls.Name, err)
+		}
+		for j := range lsps {
+			lsp := &lsps[j]
+			owner := portOwner(lsp)
+			orphan, owned := s.isOrphanOwner(owner)
+			if !owned {
+				continue
+			}
+			if !orphan {
+				s.addresses[network][lspAddress(lsp)] = true
+				continue
+			}
+			*orphans = append(*orphans, fmt.Sprintf("switch %s port %s", ls.Name, lsp.Name))
+			if err := t.remove(ls, &ls.Ports, lsp.UUID); err != nil {
+				return fmt.Errorf("failed removing switch %s port %s: %v", ls.Name, lsp.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// sweepRouters removes the reroute policies and source routes of VMIs or pods
+// that are gone and the routes and NATs of nodes that are gone from all the
+// routers
+func (s *sweeper) sweepRouters(t *nbTxn, orphans *[]string) error {
+	routers := []nbdb.LogicalRouter{}
+	if err := t.nbcli.List(context.Background(), &routers); err != nil {
+		return fmt.Errorf("failed listing routers: %v", err)
+	}
+	for i := range routers {
+		lr := &routers[i]
+
+		policies := []nbdb.LogicalRouterPolicy{}
+		if err := t.nbcli.WhereCache(func(item *nbdb.LogicalRouterPolicy) bool {
+			return containsString(lr.Policies, item.UUID) && s.isOrphanPolicy(item)
+		}).List(context.Background(), &policies); err != nil {
+			return fmt.Errorf("failed listing router %s policies: %v", lr.Name, err)
+		}
+		for _, policy := range policies {
+			*orphans = append(*orphans, fmt.Sprintf("router %s policy %q", lr.Name, policy.Match))
+			if err := t.remove(lr, &lr.Policies, policy.UUID); err != nil {
+				return fmt.Errorf("failed removing router %s policy: %v", lr.Name, err)
+			}
+		}
+
+		routes := []nbdb.LogicalRouterStaticRoute{}
+		if err := t.nbcli.WhereCache(func(item *nbdb.LogicalRouterStaticRoute) bool {
+			return containsString(lr.StaticRoutes, item.UUID) && (s.isOrphanNodeObject(item.ExternalIDs) || s.isOrphanSourceRoute(item))
+		}).List(context.Background(), &routes); err != nil {
+			return fmt.Errorf("failed listing router %s static routes: %v", lr.Name, err)
+		}
+		for _, route := range routes {
+			*orphans = append(*orphans, fmt.Sprintf("router %s route %s via %s", lr.Name, route.IPPrefix, route.Nexthop))
+			if err := t.remove(lr, &lr.StaticRoutes, route.UUID); err != nil {
+				return fmt.Errorf("failed removing router %s static route: %v", lr.Name, err)
+			}
+		}
+
+		nats := []nbdb.NAT{}
+		if err := t.nbcli.WhereCache(func(item *nbdb.NAT) bool {
+			return containsString(lr.Nat, item.UUID) && s.isOrphanNodeObject(item.ExternalIDs)
+		}).List(context.Background(), &nats); err != nil {
+			return fmt.Errorf("failed listing router %s nats: %v", lr.Name, err)
+		}
+		for _, nat := range nats {
+			*orphans = append(*orphans, fmt.Sprintf("router %s %s %s to %s of node %s", lr.Name, nat.Type, nat.LogicalIP, nat.ExternalIP, nat.ExternalIDs[nodeExternalIDKey]))
+			if err := t.remove(lr, &lr.Nat, nat.UUID); err != nil {
+				return fmt.Errorf("failed removing router %s nat: %v", lr.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// isOrphanPolicy returns true for the VM reroute policies of VMIs or pods that
+// are gone, the policies created before they had the VMI are orphan if the
+// source address is not at a kept VM port of the network
+func (s *sweeper) isOrphanPolicy(policy *nbdb.LogicalRouterPolicy) bool {
+	network, ok := policy.ExternalIDs[networkExternalIDKey]
+	if !ok || policy.Action != nbdb.LogicalRouterPolicyActionReroute {
+		return false
+	}
+	if orphan, owned := s.isOrphanOwner(policy.ExternalIDs); owned {
+		return orphan
+	}
+	address := strings.TrimPrefix(policy.Match, "ip4.src == ")
+	if address == policy.Match {
+		return false
+	}
+	return !s.addresses[network][address]
+}
+
+// isOrphanSourceRoute returns true for the VM src-ip routes of VMIs or pods
+// that are gone, like the reroute policies
+func (s *sweeper) isOrphanSourceRoute(route *nbdb.LogicalRouterStaticRoute) bool {
+	network, ok := route.ExternalIDs[networkExternalIDKey]
+	if !ok || !isVMSourceRoute(route, network) {
+		return false
+	}
+	if orphan, owned := s.isOrphanOwner(route.ExternalIDs); owned {
+		return orphan
+	}
+	return !s.addresses[network][route.IPPrefix]
+}
+
+// isOrphanNodeObject returns true for the plugin objects of nodes that are
+// gone
+func (s *sweeper) isOrphanNodeObject(externalIDs map[string]string) bool {
+	if _, ok := externalIDs[networkExternalIDKey]; !ok {
+		return false
+	}
+	node, ok := externalIDs[nodeExternalIDKey]
+	return ok && !s.nodes[node]
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+	libovsdbtest "github.com/ovn-org/ovn-kubernetes/go-controller/pkg/testing/libovsdb"
+)
+
+func TestSweep(t *testing.T) {
+	srcIP := nbdb.LogicalRouterStaticRoutePolicySrcIP
+	network := map[string]string{networkExternalIDKey: "net1"}
+	owned := func(key, value string) map[string]string {
+		return map[string]string{networkExternalIDKey: "net1", key: value}
+	}
+	lsp := func(name, address string, externalIDs map[string]string) *nbdb.LogicalSwitchPort {
+		return &nbdb.LogicalSwitchPort{
+			UUID:        name + "-uuid",
+			Name:        name,
+			Addresses:   []string{"0a:58:c0:a8:0a:01 " + address},
+			ExternalIDs: externalIDs,
+		}
+	}
+	policy := func(name, address string, externalIDs map[string]string) *nbdb.LogicalRouterPolicy {
+		return &nbdb.LogicalRouterPolicy{
+			UUID:        name + "-uuid",
+			Priority:    1005,
+			Match:       "ip4.src == " + address,
+			Action:      nbdb.LogicalRouterPolicyActionReroute,
+			Nexthops:    []string{"100.64.0.2"},
+			ExternalIDs: externalIDs,
+		}
+	}
+	route := func(name, prefix string, externalIDs map[string]string) *nbdb.LogicalRouterStaticRoute {
+		return &nbdb.LogicalRouterStaticRoute{
+			UUID:        name + "-uuid",
+			IPPrefix:    prefix,
+			Nexthop:     "100.64.0.2",
+			Policy:      &srcIP,
+			ExternalIDs: externalIDs,
+		}
+	}
+
+	lsps := []*nbdb.LogicalSwitchPort{
+		lsp("kept-vmi", "192.168.10.2", owned(vmiExternalIDKey, "ns1/vm1")),
+		lsp("orphan-vmi", "192.168.10.3", owned(vmiExternalIDKey, "ns1/gone")),
+		lsp("kept-pod", "192.168.10.4", owned(podExternalIDKey, "ns1/pod1")),
+		lsp("orphan-pod", "192.168.10.5", owned(podExternalIDKey, "ns1/gone")),
+		// Created before the ports had the owner
+		lsp("ns1_vm2", "192.168.10.6", nil),
+		lsp("ns1_gone2", "192.168.10.7", nil),
+		{UUID: "router-port-uuid", Name: "router-port", Type: "router"},
+	}
+	policies := []*nbdb.LogicalRouterPolicy{
+		policy("kept-policy", "192.168.10.2", owned(vmiExternalIDKey, "ns1/vm1")),
+		policy("orphan-policy", "192.168.10.3", owned(vmiExternalIDKey, "ns1/gone")),
+		policy("kept-pod-policy", "192.168.10.4", owned(podExternalIDKey, "ns1/pod1")),
+		policy("orphan-pod-policy", "192.168.10.5", owned(podExternalIDKey, "ns1/gone")),
+		// Created before the policies had the owner
+		policy("kept-legacy-policy", "192.168.10.6", network),
+		policy("orphan-legacy-policy", "192.168.10.7", network),
+		// Not owned by the plugin
+		policy("foreign-policy", "10.244.0.5", nil),
+		{UUID: "isolation-policy-uuid", Priority: 1100, Match: "ip4.dst == 10.244.0.0/16", Action: nbdb.LogicalRouterPolicyActionDrop, ExternalIDs: network},
+	}
+	routes := []*nbdb.LogicalRouterStaticRoute{
+		route("kept-route", "192.168.10.2", owned(vmiExternalIDKey, "ns1/vm1")),
+		route("orphan-route", "192.168.10.3", owned(vmiExternalIDKey, "ns1/gone")),
+		route("kept-legacy-route", "192.168.10.6", network),
+		route("orphan-legacy-route", "192.168.10.7", network),
+		route("subnet-route", "192.168.10.0/24", network),
+		route("foreign-route", "10.244.0.5", nil),
+		{UUID: "kept-node-route-uuid", IPPrefix: "0.0.0.0/0", Nexthop: "172.18.0.1", ExternalIDs: owned(nodeExternalIDKey, "node1")},
+		{UUID: "orphan-node-route-uuid", IPPrefix: "0.0.0.0/0", Nexthop: "172.18.0.1", ExternalIDs: owned(nodeExternalIDKey, "gone")},
+	}
+	nats := []*nbdb.NAT{
+		{UUID: "kept-nat-uuid", Type: nbdb.NATTypeSNAT, LogicalIP: "192.168.10.0/24", ExternalIP: "172.18.0.2", ExternalIDs: owned(nodeExternalIDKey, "node1")},
+		{UUID: "orphan-nat-uuid", Type: nbdb.NATTypeSNAT, LogicalIP: "192.168.10.0/24", ExternalIP: "172.18.0.3", ExternalIDs: owned(nodeExternalIDKey, "gone")},
+		{UUID: "foreign-nat-uuid", Type: nbdb.NATTypeSNAT, LogicalIP: "10.244.0.0/16", ExternalIP: "172.18.0.4", ExternalIDs: map[string]string{nodeExternalIDKey: "gone"}},
+	}
+
+	ls := &nbdb.LogicalSwitch{UUID: "ls-uuid", Name: "net1", ExternalIDs: network}
+	lr := &nbdb.LogicalRouter{UUID: "lr-uuid", Name: "router"}
+	nbData := []libovsdbtest.TestData{}
+	for _, item := range lsps {
+		ls.Ports = append(ls.Ports, item.UUID)
+		nbData = append(nbData, item)
+	}
+	for _, item := range policies {
+		lr.Policies = append(lr.Policies, item.UUID)
+		nbData = append(nbData, item)
+	}
+	for _, item := range routes {
+		lr.StaticRoutes = append(lr.StaticRoutes, item.UUID)
+		nbData = append(nbData, item)
+	}
+	for _, item := range nats {
+		lr.Nat = append(lr.Nat, item.UUID)
+		nbData = append(nbData, item)
+	}
+	nbData = append(nbData, ls, lr)
+
+	nbcli, cleanup, err := libovsdbtest.NewNBTestHarness(libovsdbtest.TestSetup{NBData: nbData}, nil)
+	if err != nil {
+		t.Fatalf("failed creating NB test harness: %v", err)
+	}
+	defer cleanup.Cleanup()
+
+	s := &sweeper{
+		vmis:      map[string]bool{"ns1/vm1": true, "ns1/vm2": true},
+		pods:      map[string]bool{"ns1/pod1": true},
+		nodes:     map[string]bool{"node1": true},
+		addresses: map[string]map[string]bool{},
+	}
+	txn := newNBTxn(nbcli)
+	orphans := []string{}
+	if err := s.sweepSwitchPorts(txn, &orphans); err != nil {
+		t.Fatalf("failed sweeping switch ports: %v", err)
+	}
+	if err := s.sweepRouters(txn, &orphans); err != nil {
+		t.Fatalf("failed sweeping routers: %v", err)
+	}
+	if err := txn.commit(); err != nil {
+		t.Fatalf("failed committing sweep: %v", err)
+	}
+	if len(orphans) != 10 {
+		t.Errorf("expected 10 orphans, got %d: %v", len(orphans), orphans)
+	}
+
+	gotLS, err := findSwitch(nbcli, "net1")
+	if err != nil || gotLS == nil {
+		t.Fatalf("failed getting switch: %v", err)
+	}
+	gotLSPs := []nbdb.LogicalSwitchPort{}
+	if err := nbcli.List(context.Background(), &gotLSPs); err != nil {
+		t.Fatalf("failed listing switch ports: %v", err)
+	}
+	names := []string{}
+	for _, item := range gotLSPs {
+		if containsString(gotLS.Ports, item.UUID) {
+			names = append(names, item.Name)
+		}
+	}
+	assertNames(t, "switch ports", names, "kept-pod", "kept-vmi", "ns1_vm2", "router-port")
+
+	gotLR, err := findRouter(nbcli, "router")
+	if err != nil || gotLR == nil {
+		t.Fatalf("failed getting router: %v", err)
+	}
+
+	gotPolicies := []nbdb.LogicalRouterPolicy{}
+	if err := nbcli.List(context.Background(), &gotPolicies); err != nil {
+		t.Fatalf("failed listing policies: %v", err)
+	}
+	names = []string{}
+	for _, item := range gotPolicies {
+		if containsString(gotLR.Policies, item.UUID) {
+			names = append(names, item.Match)
+		}
+	}
+	assertNames(t, "policies", names, "ip4.dst == 10.244.0.0/16", "ip4.src == 10.244.0.5", "ip4.src == 192.168.10.2", "ip4.src == 192.168.10.4", "ip4.src == 192.168.10.6")
+
+	gotRoutes := []nbdb.LogicalRouterStaticRoute{}
+	if err := nbcli.List(context.Background(), &gotRoutes); err != nil {
+		t.Fatalf("failed listing static routes: %v", err)
+	}
+	names = []string{}
+	for _, item := range gotRoutes {
+		if containsString(gotLR.StaticRoutes, item.UUID) {
+			names = append(names, item.IPPrefix+" via "+item.Nexthop)
+		}
+	}
+	assertNames(t, "static routes", names, "0.0.0.0/0 via 172.18.0.1", "10.244.0.5 via 100.64.0.2", "192.168.10.0/24 via 100.64.0.2", "192.168.10.2 via 100.64.0.2", "192.168.10.6 via 100.64.0.2")
+
+	gotNATs := []nbdb.NAT{}
+	if err := nbcli.List(context.Background(), &gotNATs); err != nil {
+		t.Fatalf("failed listing nats: %v", err)
+	}
+	names = []string{}
+	for _, item := range gotNATs {
+		if containsString(gotLR.Nat, item.UUID) {
+			names = append(names, item.ExternalIP)
+		}
+	}
+	assertNames(t, "nats", names, "172.18.0.2", "172.18.0.4")
+}
+
+func assertNames(t *testing.T, kind string, got []string, want ...string) {
+	t.Helper()
+	sort.Strings(got)
+	if len(got) != len(want) {
+		t.Errorf("expected %s %v, got %v", kind, want, got)
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("expected %s %v, got %v", kind, want, got)
+			return
+		}
+	}
+}
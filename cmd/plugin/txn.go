@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ovn-org/libovsdb/model"
+	"github.com/ovn-org/libovsdb/ovsdb"
+
+	ovsclient "github.com/ovn-org/libovsdb/client"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/libovsdbops"
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+)
+
+// nbTxn accumulates the NB operations of a CNI ADD so they are committed at a
+// single transaction. The rows are looked up at the cache and updated, or
+// created with a named UUID so the rest of the operations of the transaction
+// can reference them before they are at the cache.
+type nbTxn struct {
+	nbcli ovsclient.Client
+	ops   []ovsdb.Operation
+	// routers and switches are the UUIDs, real or named, of the ones
+	// ensured at the transaction by name
+	routers  map[string]string
+	switches map[string]string
+	named    int
+}
+
+func newNBTxn(nbcli ovsclient.Client) *nbTxn {
+	return &nbTxn{
+		nbcli:    nbcli,
+		routers:  map[string]string{},
+		switches: map[string]string{},
+	}
+}
+
+func (t *nbTxn) namedUUID() string {
+	t.named++
+	return fmt.Sprintf("ovnkubevirt%d", t.named)
+}
+
+// commit runs all the operations at one transaction, so nothing is changed
+// if one of them fails
+func (t *nbTxn) commit() error {
+	if len(t.ops) == 0 {
+		return nil
+	}
+	if _, err := libovsdbops.TransactAndCheck(t.nbcli, t.ops); err != nil {
+		return err
+	}
+	return nil
+}
+
+// create adds the operation to create the row with a named UUID
+func (t *nbTxn) create(m model.Model, uuid *string) error {
+	*uuid = t.namedUUID()
+	ops, err := t.nbcli.Create(m)
+	if err != nil {
+		return err
+	}
+	t.ops = append(t.ops, ops...)
+	return nil
+}
+
+// update adds the operation to update the row fields
+func (t *nbTxn) update(m model.Model, fields ...interface{}) error {
+	ops, err := t.nbcli.Where(m).Update(m, fields...)
+	if err != nil {
+		return err
+	}
+	t.ops = append(t.ops, ops...)
+	return nil
+}
+
+// delete adds the operation to delete the root row
+func (t *nbTxn) delete(m model.Model) error {
+	ops, err := t.nbcli.Where(m).Delete()
+	if err != nil {
+		return err
+	}
+	t.ops = append(t.ops, ops...)
+	return nil
+}
+
+// insert adds the uuids to the row set column, it's a no-op for the ones
+// already there
+func (t *nbTxn) insert(m model.Model, column *[]string, uuids ...string) error {
+	ops, err := t.nbcli.Where(m).Mutate(m, model.Mutation{
+		Field:   column,
+		Mutator: ovsdb.MutateOperationInsert,
+		Value:   uuids,
+	})
+	if err != nil {
+		return err
+	}
+	t.ops = append(t.ops, ops...)
+	return nil
+}
+
+// remove adds the operation to remove the uuids from the row set column, the
+// non root rows are garbage collected once they are not referenced
+func (t *nbTxn) remove(m model.Model, column *[]string, uuids ...string) error {
+	ops, err := t.nbcli.Where(m).Mutate(m, model.Mutation{
+		Field:   column,
+		Mutator: ovsdb.MutateOperationDelete,
+		Value:   uuids,
+	})
+	if err != nil {
+		return err
+	}
+	t.ops = append(t.ops, ops...)
+	return nil
+}
+
+// ensureRouter creates the router or updates its non default fields
+func (t *nbTxn) ensureRouter(lr *nbdb.LogicalRouter) error {
+	if uuid, ok := t.routers[lr.Name]; ok {
+		lr.UUID = uuid
+		return nil
+	}
+	existing, err := findRouter(t.nbcli, lr.Name)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		if err := t.create(lr, &lr.UUID); err != nil {
+			return fmt.Errorf("failed creating router %s: %v", lr.Name, err)
+		}
+	} else {
+		lr.UUID = existing.UUID
+		fields := []interface{}{}
+		if lr.Enabled != nil {
+			fields = append(fields, &lr.Enabled)
+		}
+		if len(lr.Options) > 0 {
+			fields = append(fields, &lr.Options)
+		}
+		if len(lr.ExternalIDs) > 0 {
+			fields = append(fields, &lr.ExternalIDs)
+		}
+		if len(fields) > 0 {
+			if err := t.update(lr, fields...); err != nil {
+				return fmt.Errorf("failed updating router %s: %v", lr.Name, err)
+			}
+		}
+	}
+	t.routers[lr.Name] = lr.UUID
+	return nil
+}
+
+// router returns the existing router or the one created at the transaction
+func (t *nbTxn) router(name string) (*nbdb.LogicalRouter, error) {
+	lr, err := findRouter(t.nbcli, name)
+	if err != nil {
+		return nil, err
+	}
+	if lr != nil {
+		return lr, nil
+	}
+	if uuid, ok := t.routers[name]; ok {
+		return &nbdb.LogicalRouter{UUID: uuid, Name: name}, nil
+	}
+	return nil, fmt.Errorf("missing router %s", name)
+}
+
+func findRouter(nbcli ovsclient.Client, name string) (*nbdb.LogicalRouter, error) {
+	routers, err := libovsdbops.FindLogicalRoutersWithPredicate(nbcli, func(item *nbdb.LogicalRouter) bool {
+		return item.Name == name
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed looking for router %s: %v", name, err)
+	}
+	if len(routers) == 0 {
+		return nil, nil
+	}
+	return routers[0], nil
+}
+
+// ensureSwitch creates the switch or updates its non default fields
+func (t *nbTxn) ensureSwitch(ls *nbdb.LogicalSwitch) error {
+	if uuid, ok := t.switches[ls.Name]; ok {
+		ls.UUID = uuid
+		return nil
+	}
+	existing, err := findSwitch(t.nbcli, ls.Name)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		if err := t.create(ls, &ls.UUID); err != nil {
+			return fmt.Errorf("failed creating switch %s: %v", ls.Name, err)
+		}
+	} else {
+		ls.UUID = existing.UUID
+		fields := []interface{}{}
+		if len(ls.OtherConfig) > 0 {
+			fields = append(fields, &ls.OtherConfig)
+		}
+		if len(ls.ExternalIDs) > 0 {
+			fields = append(fields, &ls.ExternalIDs)
+		}
+		if len(fields) > 0 {
+			if err := t.update(ls, fields...); err != nil {
+				return fmt.Errorf("failed updating switch %s: %v", ls.Name, err)
+			}
+		}
+	}
+	t.switches[ls.Name] = ls.UUID
+	return nil
+}
+
+func findSwitch(nbcli ovsclient.Client, name string) (*nbdb.LogicalSwitch, error) {
+	switches, err := libovsdbops.FindLogicalSwitchesWithPredicate(nbcli, func(item *nbdb.LogicalSwitch) bool {
+		return item.Name == name
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed looking for switch %s: %v", name, err)
+	}
+	if len(switches) == 0 {
+		return nil, nil
+	}
+	return switches[0], nil
+}
+
+// waitSwitchPorts makes the transaction fail if the switch ports changed
+// since they were read from the cache, so addresses allocated from them
+// are not assigned twice by concurrent transactions.
+func (t *nbTxn) waitSwitchPorts(ls *nbdb.LogicalSwitch) error {
+	timeout := 0
+	ops, err := t.nbcli.Where(ls).Wait(ovsdb.WaitConditionEqual, &timeout, ls, &ls.Ports)
+	if err != nil {
+		return fmt.Errorf("failed waiting for switch %s ports: %v", ls.Name, err)
+	}
+	t.ops = append(t.ops, ops...)
+	return nil
+}
+
+// waitNoSwitch makes the transaction fail if a switch with the name has been
+// created since the cache was read, so concurrent transactions creating the
+// switch do not allocate the same addresses from an empty one.
+func (t *nbTxn) waitNoSwitch(name string) {
+	timeout := 0
+	t.ops = append(t.ops, ovsdb.Operation{
+		Op:      ovsdb.OperationWait,
+		Table:   "Logical_Switch",
+		Timeout: &timeout,
+		Where:   []ovsdb.Condition{ovsdb.NewCondition("name", ovsdb.ConditionEqual, name)},
+		Columns: []string{"name"},
+		Until:   string(ovsdb.WaitConditionEqual),
+		Rows:    []ovsdb.Row{},
+	})
+}
+
+// ensureRouterPort creates or updates the port and adds it to the router, if
+// there is no port with the name but the UUID is set that port is renamed
+func (t *nbTxn) ensureRouterPort(routerName string, lrp *nbdb.LogicalRouterPort) error {
+	lr, err := t.router(routerName)
+	if err != nil {
+		return err
+	}
+	existing, err := libovsdbops.GetLogicalRouterPort(t.nbcli, &nbdb.LogicalRouterPort{Name: lrp.Name})
+	if err != nil && !errors.Is(err, ovsclient.ErrNotFound) {
+		return fmt.Errorf("failed getting router port %s: %v", lrp.Name, err)
+	}
+	if existing == nil && lrp.UUID != "" {
+		existing = &nbdb.LogicalRouterPort{UUID: lrp.UUID}
+	}
+	if existing == nil {
+		err = t.create(lrp, &lrp.UUID)
+	} else {
+		lrp.UUID = existing.UUID
+		err = t.update(lrp, &lrp.Name, &lrp.MAC, &lrp.Networks, &lrp.Enabled, &lrp.Peer, &lrp.ExternalIDs)
+	}
+	if err != nil {
+		return fmt.Errorf("failed ensuring router port %s: %v", lrp.Name, err)
+	}
+	return t.insert(lr, &lr.Ports, lrp.UUID)
+}
+
+// ensureSwitchPort creates or updates the port and adds it to the switch, if
+// there is no port with the name but the UUID is set that port is renamed
+func (t *nbTxn) ensureSwitchPort(switchName string, lsp *nbdb.LogicalSwitchPort) error {
+	uuid, ok := t.switches[switchName]
+	if !ok {
+		return fmt.Errorf("missing switch %s", switchName)
+	}
+	existing, err := libovsdbops.GetLogicalSwitchPort(t.nbcli, &nbdb.LogicalSwitchPort{Name: lsp.Name})
+	if err != nil && !errors.Is(err, ovsclient.ErrNotFound) {
+		return fmt.Errorf("failed getting switch port %s: %v", lsp.Name, err)
+	}
+	if existing == nil && lsp.UUID != "" {
+		existing = &nbdb.LogicalSwitchPort{UUID: lsp.UUID}
+	}
+	if existing == nil {
+		err = t.create(lsp, &lsp.UUID)
+	} else {
+		lsp.UUID = existing.UUID
+		err = t.update(lsp, &lsp.Name, &lsp.Addresses, &lsp.Type, &lsp.Options, &lsp.Enabled, &lsp.Dhcpv4Options, &lsp.ExternalIDs)
+	}
+	if err != nil {
+		return fmt.Errorf("failed ensuring switch port %s: %v", lsp.Name, err)
+	}
+	ls := &nbdb.LogicalSwitch{UUID: uuid, Name: switchName}
+	return t.insert(ls, &ls.Ports, lsp.UUID)
+}
+
+// ensureRouterPolicy creates the policy or updates the router policy matching
+// the predicate and adds it to the router, the rest of the router policies
+// matching it are duplicates and are removed
+func (t *nbTxn) ensureRouterPolicy(routerName string, policy *nbdb.LogicalRouterPolicy, predicate func(*nbdb.LogicalRouterPolicy) bool) error {
+	lr, err := t.router(routerName)
+	if err != nil {
+		return err
+	}
+	policies, err := libovsdbops.FindLogicalRouterPoliciesWithPredicate(t.nbcli, func(item *nbdb.LogicalRouterPolicy) bool {
+		return containsString(lr.Policies, item.UUID) && predicate(item)
+	})
+	if err != nil {
+		return fmt.Errorf("failed looking for router %s policies: %v", routerName, err)
+	}
+	if len(policies) == 0 {
+		err = t.create(policy, &policy.UUID)
+	} else {
+		policy.UUID = policies[0].UUID
+		err = t.update(policy, &policy.Match, &policy.Action, &policy.Priority, &policy.Nexthops, &policy.ExternalIDs)
+	}
+	if err != nil {
+		return fmt.Errorf("failed ensuring router %s policy: %v", routerName, err)
+	}
+	if len(policies) > 1 {
+		for _, duplicate := range policies[1:] {
+			if err := t.remove(lr, &lr.Policies, duplicate.UUID); err != nil {
+				return fmt.Errorf("failed removing router %s duplicate policy: %v", routerName, err)
+			}
+		}
+	}
+	return t.insert(lr, &lr.Policies, policy.UUID)
+}
+
+// deleteRouterPolicies removes the router policies matching the predicate
+func (t *nbTxn) deleteRouterPolicies(routerName string, predicate func(*nbdb.LogicalRouterPolicy) bool) error {
+	lr, err := findRouter(t.nbcli, routerName)
+	if err != nil || lr == nil {
+		// A router that is not at the cache has no policies
+		return err
+	}
+	t.ops, err = libovsdbops.DeleteLogicalRouterPolicyWithPredicateOps(t.nbcli, t.ops, routerName, predicate)
+	if err != nil {
+		return fmt.Errorf("failed removing router %s policies: %v", routerName, err)
+	}
+	return nil
+}
+
+// ensureRouterStaticRoute creates the route or updates the one matching the
+// predicate and adds it to the router
+func (t *nbTxn) ensureRouterStaticRoute(routerName string, route *nbdb.LogicalRouterStaticRoute, predicate func(*nbdb.LogicalRouterStaticRoute) bool) error {
+	lr, err := t.router(routerName)
+	if err != nil {
+		return err
+	}
+	routes, err := libovsdbops.FindLogicalRouterStaticRoutesWithPredicate(t.nbcli, func(item *nbdb.LogicalRouterStaticRoute) bool {
+		return containsString(lr.StaticRoutes, item.UUID) && predicate(item)
+	})
+	if err != nil {
+		return fmt.Errorf("failed looking for router %s static routes: %v", routerName, err)
+	}
+	if len(routes) == 0 {
+		err = t.create(route, &route.UUID)
+	} else {
+		route.UUID = routes[0].UUID
+		err = t.update(route, &route.IPPrefix, &route.Nexthop, &route.Policy, &route.OutputPort, &route.ExternalIDs)
+	}
+	if err != nil {
+		return fmt.Errorf("failed ensuring router %s static route: %v", routerName, err)
+	}
+	return t.insert(lr, &lr.StaticRoutes, route.UUID)
+}
+
+// deleteRouterStaticRoutes removes the router static routes matching the
+// predicate
+func (t *nbTxn) deleteRouterStaticRoutes(routerName string, predicate func(*nbdb.LogicalRouterStaticRoute) bool) error {
+	lr, err := findRouter(t.nbcli, routerName)
+	if err != nil || lr == nil {
+		// A router that is not at the cache has no routes
+		return err
+	}
+	routes, err := libovsdbops.FindLogicalRouterStaticRoutesWithPredicate(t.nbcli, func(item *nbdb.LogicalRouterStaticRoute) bool {
+		return containsString(lr.StaticRoutes, item.UUID) && predicate(item)
+	})
+	if err != nil {
+		return fmt.Errorf("failed looking for router %s static routes: %v", routerName, err)
+	}
+	for _, route := range routes {
+		if err := t.remove(lr, &lr.StaticRoutes, route.UUID); err != nil {
+			return fmt.Errorf("failed removing router %s static route: %v", routerName, err)
+		}
+	}
+	return nil
+}
+
+// ensureRouterNAT creates the NAT or updates the router NAT matching the
+// predicate and adds it to the router
+func (t *nbTxn) ensureRouterNAT(routerName string, nat *nbdb.NAT, predicate func(*nbdb.NAT) bool) error {
+	lr, err := t.router(routerName)
+	if err != nil {
+		return err
+	}
+	nats := []nbdb.NAT{}
+	if err := t.nbcli.WhereCache(func(item *nbdb.NAT) bool {
+		return containsString(lr.Nat, item.UUID) && predicate(item)
+	}).List(context.Background(), &nats); err != nil {
+		return fmt.Errorf("failed looking for router %s nats: %v", routerName, err)
+	}
+	if len(nats) == 0 {
+		err = t.create(nat, &nat.UUID)
+	} else {
+		nat.UUID = nats[0].UUID
+		err = t.update(nat, &nat.Type, &nat.ExternalIP, &nat.LogicalIP, &nat.Options, &nat.ExternalIDs)
+	}
+	if err != nil {
+		return fmt.Errorf("failed ensuring router %s nat: %v", routerName, err)
+	}
+	return t.insert(lr, &lr.Nat, nat.UUID)
+}
+
+// ensureAddressSet creates the address set or updates the one with its name
+func (t *nbTxn) ensureAddressSet(as *nbdb.AddressSet) error {
+	existing := []nbdb.AddressSet{}
+	if err := t.nbcli.WhereCache(func(item *nbdb.AddressSet) bool {
+		return item.Name == as.Name
+	}).List(context.Background(), &existing); err != nil {
+		return fmt.Errorf("failed listing address sets: %v", err)
+	}
+	var err error
+	if len(existing) == 0 {
+		err = t.create(as, &as.UUID)
+	} else {
+		as.UUID = existing[0].UUID
+		err = t.update(as, &as.Addresses, &as.ExternalIDs)
+	}
+	if err != nil {
+		return fmt.Errorf("failed ensuring address set %s: %v", as.Name, err)
+	}
+	return nil
+}
+
+// ensureDHCPOptions creates the DHCP options or updates the ones matching
+// the predicate
+func (t *nbTxn) ensureDHCPOptions(dhcpOptions *nbdb.DHCPOptions, predicate func(*nbdb.DHCPOptions) bool) error {
+	existing := []nbdb.DHCPOptions{}
+	if err := t.nbcli.WhereCache(predicate).List(context.Background(), &existing); err != nil {
+		return fmt.Errorf("failed listing dhcp options: %v", err)
+	}
+	var err error
+	if len(existing) == 0 {
+		err = t.create(dhcpOptions, &dhcpOptions.UUID)
+	} else {
+		dhcpOptions.UUID = existing[0].UUID
+		err = t.update(dhcpOptions, &dhcpOptions.Cidr, &dhcpOptions.Options, &dhcpOptions.ExternalIDs)
+	}
+	if err != nil {
+		return fmt.Errorf("failed ensuring dhcp options: %v", err)
+	}
+	return nil
+}
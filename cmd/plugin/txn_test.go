@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ovn-org/ovn-kubernetes/go-controller/pkg/nbdb"
+	libovsdbtest "github.com/ovn-org/ovn-kubernetes/go-controller/pkg/testing/libovsdb"
+)
+
+func TestEnsureRouterPolicy(t *testing.T) {
+	vmPolicy := func(uuid, nexthop string) *nbdb.LogicalRouterPolicy {
+		return &nbdb.LogicalRouterPolicy{
+			UUID:        uuid,
+			Priority:    1005,
+			Match:       "ip4.src == 192.168.10.2",
+			Action:      nbdb.LogicalRouterPolicyActionReroute,
+			Nexthops:    []string{nexthop},
+			ExternalIDs: map[string]string{networkExternalIDKey: "net1"},
+		}
+	}
+	otherPolicy := &nbdb.LogicalRouterPolicy{
+		UUID:        "other-uuid",
+		Priority:    1005,
+		Match:       "ip4.src == 192.168.10.3",
+		Action:      nbdb.LogicalRouterPolicyActionReroute,
+		Nexthops:    []string{"100.64.0.2"},
+		ExternalIDs: map[string]string{networkExternalIDKey: "net1"},
+	}
+	// Not at the router
+	detachedPolicy := vmPolicy("detached-uuid", "100.64.0.5")
+
+	tests := []struct {
+		name     string
+		policies []*nbdb.LogicalRouterPolicy
+	}{
+		{
+			name: "creates the policy",
+		},
+		{
+			name:     "updates the policy",
+			policies: []*nbdb.LogicalRouterPolicy{vmPolicy("vm1-uuid", "100.64.0.2")},
+		},
+		{
+			name: "removes the duplicates",
+			policies: []*nbdb.LogicalRouterPolicy{
+				vmPolicy("vm1-uuid", "100.64.0.2"),
+				vmPolicy("vm2-uuid", "100.64.0.3"),
+				vmPolicy("vm3-uuid", "100.64.0.4"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lr := &nbdb.LogicalRouter{UUID: "lr-uuid", Name: "router", Policies: []string{otherPolicy.UUID}}
+			nbData := []libovsdbtest.TestData{otherPolicy, detachedPolicy}
+			for _, policy := range tt.policies {
+				lr.Policies = append(lr.Policies, policy.UUID)
+				nbData = append(nbData, policy)
+			}
+			nbData = append(nbData, lr)
+			nbcli, cleanup, err := libovsdbtest.NewNBTestHarness(libovsdbtest.TestSetup{NBData: nbData}, nil)
+			if err != nil {
+				t.Fatalf("failed creating NB test harness: %v", err)
+			}
+			defer cleanup.Cleanup()
+
+			txn := newNBTxn(nbcli)
+			policy := vmPolicy("", "100.64.0.9")
+			if err := txn.ensureRouterPolicy("router", policy, func(item *nbdb.LogicalRouterPolicy) bool {
+				return item.Match == policy.Match && item.ExternalIDs[networkExternalIDKey] == "net1"
+			}); err != nil {
+				t.Fatalf("failed ensuring policy: %v", err)
+			}
+			if err := txn.commit(); err != nil {
+				t.Fatalf("failed committing policy: %v", err)
+			}
+
+			gotLR, err := findRouter(nbcli, "router")
+			if err != nil || gotLR == nil {
+				t.Fatalf("failed getting router: %v", err)
+			}
+			policies := []nbdb.LogicalRouterPolicy{}
+			if err := nbcli.List(context.Background(), &policies); err != nil {
+				t.Fatalf("failed listing policies: %v", err)
+			}
+			matching := []nbdb.LogicalRouterPolicy{}
+			keptOther := false
+			for _, item := range policies {
+				if !containsString(gotLR.Policies, item.UUID) {
+					continue
+				}
+				switch item.Match {
+				case policy.Match:
+					matching = append(matching, item)
+				case otherPolicy.Match:
+					keptOther = true
+				}
+			}
+			if len(matching) != 1 {
+				t.Fatalf("expected one router policy for %q, got %d", policy.Match, len(matching))
+			}
+			if len(matching[0].Nexthops) != 1 || matching[0].Nexthops[0] != "100.64.0.9" {
+				t.Errorf("expected router policy nexthop 100.64.0.9, got %v", matching[0].Nexthops)
+			}
+			if !keptOther {
+				t.Errorf("expected router policy %q to be kept", otherPolicy.Match)
+			}
+			if len(gotLR.Policies) != 2 {
+				t.Errorf("expected 2 router policies, got %d", len(gotLR.Policies))
+			}
+		})
+	}
+}
@@ -1,99 +1,393 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 
 	expect "github.com/google/goexpect"
 )
 
 const (
-	interval = time.Second
+	exitOK = iota
+	// the session cannot be established or re-established
+	exitProbeFailed
+	exitUsage
+	exitLatencyExceeded
+	// the session was dropped at least once
+	exitSessionDropped
 )
 
-func main() {
-	keyPath := "/home/ellorent/.ssh/id_ed25519"
-	key, err := os.ReadFile(keyPath)
+type config struct {
+	address        string
+	user           string
+	keyPath        string
+	knownHostsPath string
+	insecure       bool
+	prompt         string
+	command        string
+	expected       string
+	interval       time.Duration
+	timeout        time.Duration
+	keepalive      time.Duration
+	duration       time.Duration
+	count          int
+	maxLatency     time.Duration
+	reconnect      bool
+	verbose        bool
+}
+
+// envOrDefault returns the value of the env var or def if it's not set, it
+// allows to configure the prober at CI without composing flags.
+func envOrDefault(name, def string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return def
+}
+
+func parseConfig() (*config, error) {
+	home, _ := os.UserHomeDir()
+	cfg := &config{}
+	flag.StringVar(&cfg.user, "user", envOrDefault("SSH_PROBE_USER", "fedora"), "ssh user [SSH_PROBE_USER]")
+	flag.StringVar(&cfg.keyPath, "key", envOrDefault("SSH_PROBE_KEY", filepath.Join(home, ".ssh", "id_ed25519")), "private key path [SSH_PROBE_KEY]")
+	flag.StringVar(&cfg.knownHostsPath, "known-hosts", envOrDefault("SSH_PROBE_KNOWN_HOSTS", filepath.Join(home, ".ssh", "known_hosts")), "known_hosts path used to verify the host key [SSH_PROBE_KNOWN_HOSTS]")
+	flag.BoolVar(&cfg.insecure, "insecure", envOrDefault("SSH_PROBE_INSECURE", "") == "true", "do not verify the host key [SSH_PROBE_INSECURE=true]")
+	flag.StringVar(&cfg.prompt, "prompt", envOrDefault("SSH_PROBE_PROMPT", `\$`), "regex matching the shell prompt [SSH_PROBE_PROMPT]")
+	flag.StringVar(&cfg.command, "command", envOrDefault("SSH_PROBE_COMMAND", "pwd"), "command to run at every probe [SSH_PROBE_COMMAND]")
+	flag.StringVar(&cfg.expected, "expect", envOrDefault("SSH_PROBE_EXPECT", ".*/home/.*"), "regex matching the command output [SSH_PROBE_EXPECT]")
+	flag.DurationVar(&cfg.interval, "interval", time.Second, "time between probes")
+	flag.DurationVar(&cfg.timeout, "timeout", 10*time.Minute, "time to wait for a probe to finish")
+	flag.DurationVar(&cfg.keepalive, "keepalive-timeout", 5*time.Second, "time to wait for the keepalive reply after a probe timed out")
+	flag.DurationVar(&cfg.duration, "duration", 0, "stop probing after this duration, 0 means forever")
+	flag.IntVar(&cfg.count, "count", 0, "stop probing after this number of probes, 0 means forever")
+	flag.DurationVar(&cfg.maxLatency, "max-latency", 0, fmt.Sprintf("exit with %d if a probe takes longer than this, 0 disables it", exitLatencyExceeded))
+	flag.BoolVar(&cfg.reconnect, "reconnect", false, "reconnect after the session is dropped and measure the time to reconnect")
+	flag.BoolVar(&cfg.verbose, "verbose", false, "print the ssh session")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] host [port]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	port := "22"
+	switch flag.NArg() {
+	case 2:
+		port = flag.Arg(1)
+	case 1:
+	default:
+		return nil, fmt.Errorf("missing host")
+	}
+	cfg.address = net.JoinHostPort(flag.Arg(0), port)
+
+	for _, r := range []string{cfg.prompt, cfg.expected} {
+		if _, err := regexp.Compile(r); err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %v", r, err)
+		}
+	}
+	return cfg, nil
+}
+
+func sshClientConfig(cfg *config) (*ssh.ClientConfig, error) {
+	key, err := os.ReadFile(cfg.keyPath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	signer, err := ssh.ParsePrivateKey(key)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !cfg.insecure {
+		hostKeyCallback, err = knownhosts.New(cfg.knownHostsPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading known hosts, use -insecure to skip host key verification: %v", err)
+		}
 	}
-	// ssh config
-	config := &ssh.ClientConfig{
-		User:            "fedora",
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+
+	return &ssh.ClientConfig{
+		User:            cfg.user,
+		HostKeyCallback: hostKeyCallback,
 		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+	}, nil
+}
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	cfg, err := parseConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		return exitUsage
 	}
+
+	sshConfig, err := sshClientConfig(cfg)
+	if err != nil {
+		log.Println(err)
+		return exitUsage
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if cfg.duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cfg.duration)
+		defer cancel()
+	}
+
+	s, err := connect(cfg, sshConfig)
+	if err != nil {
+		log.Println(err)
+		return exitProbeFailed
+	}
+
+	p := &prober{cfg: cfg, sshConfig: sshConfig, session: s}
+	code := p.run(ctx)
+	p.session.close()
+	p.printSummary()
+	return code
+}
+
+// session is an ssh connection with a shell spawned at it
+type session struct {
+	conn    *ssh.Client
+	e       *expect.GExpect
+	dropped chan struct{}
+	closed  sync.Once
+}
+
+func connect(cfg *config, sshConfig *ssh.ClientConfig) (*session, error) {
 	// connect ot ssh server
-	address := fmt.Sprintf("%s:%s", os.Args[1], os.Args[2])
-	conn, err := ssh.Dial("tcp", address, config)
+	conn, err := ssh.Dial("tcp", cfg.address, sshConfig)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer conn.Close()
 
-	e, _, err := expect.SpawnSSH(conn, time.Minute, expect.Verbose(true))
+	e, _, err := expect.SpawnSSH(conn, time.Minute, expect.Verbose(cfg.verbose))
 	if err != nil {
-		log.Fatal(err)
+		conn.Close()
+		return nil, err
 	}
-	defer e.Close()
 
-	max := time.Duration(0)
-	for true {
-		start := time.Now()
-		_, err = e.ExpectBatch([]expect.Batcher{
-			&expect.BSnd{S: "\n"},
-			&expect.BExp{R: "\\$"},
-			&expect.BSnd{S: "pwd\n"},
-			//&expect.BExp{R: "$"},
-			&expect.BExp{R: ".*/home/fedora.*"},
-		}, 10*time.Minute)
-		if err != nil {
-			log.Fatal(err)
+	s := &session{conn: conn, e: e, dropped: make(chan struct{})}
+	go func() {
+		conn.Wait()
+		close(s.dropped)
+	}()
+	return s, nil
+}
+
+func (s *session) isDropped() bool {
+	select {
+	case <-s.dropped:
+		return true
+	default:
+		return false
+	}
+}
+
+// isAlive returns true if the ssh server answers a keepalive request before
+// the timeout, a blackholed connection is not dropped until the request
+// fails
+func (s *session) isAlive(ctx context.Context, timeout time.Duration) bool {
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := s.conn.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+	select {
+	case err := <-reply:
+		return err == nil
+	case <-s.dropped:
+	case <-ctx.Done():
+	case <-time.After(timeout):
+	}
+	return false
+}
+
+// close is idempotent since an aborted probe closes the session too
+func (s *session) close() {
+	s.closed.Do(func() {
+		s.e.Close()
+		s.conn.Close()
+	})
+}
+
+type prober struct {
+	cfg       *config
+	sshConfig *ssh.ClientConfig
+	session   *session
+	latencies []time.Duration
+	drops     int
+	// unresponsive are the probes that timed out with the session still up
+	unresponsive   int
+	reconnectTimes []time.Duration
+}
+
+// run runs the command until the count or duration limit is reached and
+// returns the exit code
+func (p *prober) run(ctx context.Context) int {
+	for i := 0; p.cfg.count == 0 || i < p.cfg.count; i++ {
+		if i > 0 && !sleep(ctx, p.cfg.interval) {
+			break
+		}
+		elapsed, err := p.probe(ctx)
+		if ctx.Err() != nil {
+			break
 		}
-		elapsed := time.Since(start)
-		if elapsed > max {
-			max = elapsed
+		if err == nil {
+			p.latencies = append(p.latencies, elapsed)
+			fmt.Printf("latency: %s, max: %s\n", elapsed, maxDuration(p.latencies))
+			continue
 		}
-		fmt.Printf("latency: %s, max: %s\n", elapsed, max)
-		time.Sleep(interval)
+
+		// A probe that times out with the session still up is not a drop,
+		// the session is kept and probed again
+		if !p.session.isDropped() && p.session.isAlive(ctx, p.cfg.keepalive) {
+			p.unresponsive++
+			log.Printf("probe unresponsive after %s: %v", p.cfg.timeout, err)
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		p.drops++
+		droppedAt := time.Now()
+		log.Printf("session dropped: %v", err)
+		if !p.cfg.reconnect {
+			return exitSessionDropped
+		}
+		if !p.reconnect(ctx) {
+			return exitProbeFailed
+		}
+		reconnectTime := time.Since(droppedAt)
+		p.reconnectTimes = append(p.reconnectTimes, reconnectTime)
+		log.Printf("session reconnected after %s", reconnectTime)
+	}
+	if p.drops > 0 {
+		return exitSessionDropped
+	}
+	if p.cfg.maxLatency > 0 && maxDuration(p.latencies) > p.cfg.maxLatency {
+		log.Printf("max latency %s is above %s", maxDuration(p.latencies), p.cfg.maxLatency)
+		return exitLatencyExceeded
 	}
+	// The unresponsive probes took longer than the timeout
+	if p.cfg.maxLatency > 0 && p.unresponsive > 0 {
+		log.Printf("%d probes were unresponsive after %s", p.unresponsive, p.cfg.timeout)
+		return exitLatencyExceeded
+	}
+	return exitOK
+}
 
-	/*
-		session, err := conn.NewSession()
-		if err != nil {
-			log.Fatal(err)
+// probe runs the command at the session, it's closed if ctx is done so the
+// probe doesn't block until the timeout
+func (p *prober) probe(ctx context.Context) (time.Duration, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func(s *session) {
+		select {
+		case <-ctx.Done():
+			s.close()
+		case <-done:
 		}
+	}(p.session)
+
+	start := time.Now()
+	_, err := p.session.e.ExpectBatch([]expect.Batcher{
+		&expect.BSnd{S: "\n"},
+		&expect.BExp{R: p.cfg.prompt},
+		&expect.BSnd{S: p.cfg.command + "\n"},
+		&expect.BExp{R: p.cfg.expected},
+	}, p.cfg.timeout)
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
 
-		var sessionStdout, sessionStderr bytes.Buffer
-		session.Stdout = &sessionStdout
-		session.Stderr = &sessionStderr
-		stdin, err := session.StdinPipe()
+// reconnect retries connecting until it succeeds and the first probe passes
+// or ctx is done. The replaced sessions are closed here and the last one by
+// the caller.
+func (p *prober) reconnect(ctx context.Context) bool {
+	for sleep(ctx, p.cfg.interval) {
+		s, err := connect(p.cfg, p.sshConfig)
 		if err != nil {
-			log.Fatal(err)
+			continue
 		}
-
-		if err := session.Shell(); err != nil {
-			log.Fatal(err)
+		p.session.close()
+		p.session = s
+		if _, err := p.probe(ctx); err != nil {
+			continue
 		}
+		return true
+	}
+	return false
+}
+
+func (p *prober) printSummary() {
+	fmt.Printf("probes: %d, unresponsive: %d, drops: %d, reconnects: %d\n", len(p.latencies), p.unresponsive, p.drops, len(p.reconnectTimes))
+	fmt.Printf("latency max: %s, p50: %s, p90: %s, p99: %s\n", maxDuration(p.latencies),
+		percentile(p.latencies, 50), percentile(p.latencies, 90), percentile(p.latencies, 99))
+	if len(p.reconnectTimes) > 0 {
+		fmt.Printf("time to reconnect max: %s\n", maxDuration(p.reconnectTimes))
+	}
+	if p.drops == 0 && p.unresponsive > 0 {
+		fmt.Println("session survived with unresponsive probes")
+	} else if p.drops == 0 {
+		fmt.Println("session survived")
+	} else {
+		fmt.Println("session dropped")
+	}
+}
+
+// sleep waits for d and returns false if ctx is done before
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
 
-		for true {
-			fmt.Println("---> WriteString <---")
-			if _, err := io.WriteString(stdin, "date\n"); err != nil {
-				log.Fatal(fmt.Errorf("%s:%s:%v", sessionStdout.String(), sessionStderr.String(), err))
-			}
-			fmt.Println("---> Println <---")
-			fmt.Println(sessionStdout.String())
-			fmt.Println("---> Sleep <---")
-			time.Sleep(time.Second)
+func maxDuration(durations []time.Duration) time.Duration {
+	max := time.Duration(0)
+	for _, d := range durations {
+		if d > max {
+			max = d
 		}
-	*/
+	}
+	return max
+}
 
+// percentile uses the nearest-rank method
+func percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
 }
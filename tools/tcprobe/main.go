@@ -2,30 +2,129 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/guptarohit/asciigraph"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
 	clientMsg      = "ping"
 	serverMsg      = "pong"
+	helloMsg       = "hello"
 	curRow         = 2
 	upperLimitRow  = 1
 	buttonLimitRow = 0
 	rows           = 3
-	interval       = time.Second / 8
-	upperLimit     = 30 * time.Millisecond
-	buttonLimit    = 0
 )
 
-//ref madflojo.medium.com/keeping-tcp-connections-alive-in-golang-801a78b7cf1
-func server(addr *net.TCPAddr) error {
+type clientStats struct {
+	ID            string    `json:"id"`
+	Address       string    `json:"address"`
+	Active        int       `json:"active"`
+	Connections   int       `json:"connections"`
+	Disconnects   int       `json:"disconnects"`
+	Pings         int       `json:"pings"`
+	FirstSeen     time.Time `json:"firstSeen"`
+	LastSeen      time.Time `json:"lastSeen"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastConnected time.Time `json:"lastConnected"`
+	// label is the client metrics label, the ID of the clients that sent
+	// the hello message or unknownClient
+	label string
+}
+
+// unknownClient is the metrics label of the clients without hello message,
+// they are identified by their address, so a label per client would be a
+// new series at every reconnection
+const unknownClient = "unknown"
+
+// serverStats keeps track of the clients connected to the server, they are
+// indexed by the ID they send at the hello message so stats survive client
+// reconnections, even for clients masqueraded behind the same IP.
+type serverStats struct {
+	sync.Mutex
+	clients map[string]*clientStats
+}
+
+func newServerStats() *serverStats {
+	return &serverStats{clients: map[string]*clientStats{}}
+}
+
+func (s *serverStats) connected(id string, hello bool, addr net.Addr) {
+	s.Lock()
+	defer s.Unlock()
+	stats, ok := s.clients[id]
+	if !ok {
+		stats = &clientStats{ID: id, FirstSeen: time.Now(), label: unknownClient}
+		if hello {
+			stats.label = id
+		}
+		s.clients[id] = stats
+	}
+	stats.Address = addr.String()
+	stats.Active++
+	stats.Connections++
+	serverConnections.WithLabelValues(stats.label).Inc()
+	serverActiveConnections.WithLabelValues(stats.label).Inc()
+	stats.LastConnected = time.Now()
+	stats.LastSeen = stats.LastConnected
+}
+
+func (s *serverStats) pinged(id string) {
+	s.Lock()
+	defer s.Unlock()
+	stats := s.clients[id]
+	stats.Pings++
+	serverPings.WithLabelValues(stats.label).Inc()
+	stats.LastSeen = time.Now()
+}
+
+func (s *serverStats) disconnected(id string, err error) {
+	s.Lock()
+	defer s.Unlock()
+	stats := s.clients[id]
+	stats.Active--
+	stats.Disconnects++
+	serverActiveConnections.WithLabelValues(stats.label).Dec()
+	serverDisconnects.WithLabelValues(stats.label).Inc()
+	stats.LastError = err.Error()
+}
+
+func (s *serverStats) unexpectedMessage(id string) {
+	s.Lock()
+	defer s.Unlock()
+	serverUnexpectedMessages.WithLabelValues(s.clients[id].label).Inc()
+}
+
+func (s *serverStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	clients := make([]clientStats, 0, len(s.clients))
+	for _, stats := range s.clients {
+		clients = append(clients, *stats)
+	}
+	s.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(clients); err != nil {
+		log.Printf("Unable to encode stats: %v", err)
+	}
+}
+
+// ref madflojo.medium.com/keeping-tcp-connections-alive-in-golang-801a78b7cf1
+func server(addr *net.TCPAddr, mux *http.ServeMux) error {
+	stats := newServerStats()
+	mux.Handle("/stats", stats)
 
 	// Start TCP Listener
 	l, err := net.ListenTCP("tcp", addr)
@@ -33,67 +132,155 @@ func server(addr *net.TCPAddr) error {
 		return fmt.Errorf("Unable to start listener: %v", err)
 	}
 
-	// Wait for new connections and send them to reader()
-	c, err := l.AcceptTCP()
-	if err != nil {
-		return fmt.Errorf("Listener returned: %v", err)
+	// Wait for new connections and serve each of them at its own goroutine
+	for {
+		c, err := l.AcceptTCP()
+		if err != nil {
+			return fmt.Errorf("Listener returned: %v", err)
+		}
+		go func() {
+			defer c.Close()
+			err := serve(c, stats)
+			log.Printf("disconnected: %s: %v", c.RemoteAddr(), err)
+		}()
 	}
+}
 
-	// Enable Keepalives
-	err = c.SetKeepAlive(false)
+func serve(c *net.TCPConn, stats *serverStats) error {
+	// Disable Keepalives
+	err := c.SetKeepAlive(false)
 	if err != nil {
 		return fmt.Errorf("Unable to set keepalive: %v", err)
 	}
-	for true {
-		msg, err := bufio.NewReader(c).ReadString('\n')
-		if err != nil {
-			return fmt.Errorf("Unable to read from client: %v", err)
-		}
-		msg = strings.TrimSuffix(msg, "\n")
-		if msg != clientMsg {
-			return fmt.Errorf("Received unexpected server message: %s", msg)
-		}
-		log.Println("received: " + msg)
-		log.Println("send: " + serverMsg)
-		_, err = fmt.Fprintf(c, fmt.Sprintf("%s\n", serverMsg))
+	reader := bufio.NewReader(c)
+	msg, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("Unable to read from client: %v", err)
+	}
+	msg = strings.TrimSuffix(msg, "\n")
+
+	// Clients that don't send the hello message are identified by their
+	// address, so their reconnections are new clients
+	id := c.RemoteAddr().String()
+	hello := strings.HasPrefix(msg, helloMsg+" ")
+	if hello {
+		id = strings.TrimPrefix(msg, helloMsg+" ")
+	}
+	stats.connected(id, hello, c.RemoteAddr())
+	log.Printf("connected: %s as %s", c.RemoteAddr(), id)
+	if !hello {
+		err = pong(c, stats, id, msg)
+	}
+	for err == nil {
+		msg, err = reader.ReadString('\n')
 		if err != nil {
-			return fmt.Errorf("Unable to send msg: %v", err)
+			err = fmt.Errorf("Unable to read from client: %v", err)
+			break
 		}
+		err = pong(c, stats, id, strings.TrimSuffix(msg, "\n"))
+	}
+	stats.disconnected(id, err)
+	return err
+}
+
+// pong answers the client ping message
+func pong(c *net.TCPConn, stats *serverStats, id, msg string) error {
+	if msg != clientMsg {
+		stats.unexpectedMessage(id)
+		return fmt.Errorf("Received unexpected client message: %s", msg)
+	}
+	stats.pinged(id)
+	if _, err := fmt.Fprintf(c, "%s\n", serverMsg); err != nil {
+		return fmt.Errorf("Unable to send msg: %v", err)
 	}
 	return nil
 }
 
-func client(addr *net.TCPAddr) error {
-	graph := NewResponseTimeGraph()
-	// Open TCP Connection
-	c, err := net.DialTCP("tcp", nil, addr)
-	if err != nil {
-		return fmt.Errorf("Unable to dial to server: %v", err)
+// client pings the server each interval and plots the response time, if the
+// connection is lost, or the server doesn't answer before the timeout, it
+// keeps trying to reconnect.
+func client(addr *net.TCPAddr, id string, interval, timeout time.Duration, plotter Plotter) error {
+	// lastPong is used to calculate the outage duration after reconnecting
+	lastPong := time.Now()
+	reconnecting := false
+	for {
+		c := dial(addr, interval, timeout)
+		if reconnecting {
+			clientReconnects.Inc()
+			log.Printf("reconnected after %s", time.Since(lastPong))
+		}
+		err := ping(c, id, interval, timeout, func(elapsed time.Duration) {
+			now := time.Now()
+			if reconnecting {
+				clientLastOutage.Set(now.Sub(lastPong).Seconds())
+				reconnecting = false
+			}
+			lastPong = now
+			clientRTT.Observe(elapsed.Seconds())
+			plotter.Plot(elapsed)
+		})
+		c.Close()
+		clientDisconnects.Inc()
+		reconnecting = true
+		log.Printf("disconnected: %v", err)
 	}
+}
 
-	err = c.SetKeepAlive(false)
+// dial connects to the server, retrying each interval until it succeeds
+func dial(addr *net.TCPAddr, interval, timeout time.Duration) *net.TCPConn {
+	failed := false
+	for {
+		c, err := net.DialTimeout("tcp", addr.String(), timeout)
+		if err == nil {
+			return c.(*net.TCPConn)
+		}
+		if !failed {
+			log.Printf("Unable to dial to server, retrying: %v", err)
+			failed = true
+		}
+		time.Sleep(interval)
+	}
+}
+
+// ping sends a ping each interval until the connection fails, a pong not
+// received before the timeout fails it too since a blackholed connection
+// never returns an error
+func ping(c *net.TCPConn, id string, interval, timeout time.Duration, onPong func(elapsed time.Duration)) error {
+	err := c.SetKeepAlive(false)
 	if err != nil {
 		return fmt.Errorf("Unable to set keepalive: %v", err)
 	}
-	for true {
+	// The server identifies the client by the hello message ID
+	if err := c.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("Unable to set deadline: %v", err)
+	}
+	_, err = fmt.Fprintf(c, "%s %s\n", helloMsg, id)
+	if err != nil {
+		return fmt.Errorf("Unable to send msg: %v", err)
+	}
+	reader := bufio.NewReader(c)
+	for {
 		time.Sleep(interval)
 		start := time.Now()
+		if err := c.SetDeadline(start.Add(timeout)); err != nil {
+			return fmt.Errorf("Unable to set deadline: %v", err)
+		}
 		_, err = fmt.Fprintf(c, clientMsg+"\n")
 		if err != nil {
 			return fmt.Errorf("Unable to send msg: %v", err)
 		}
-		msg, err := bufio.NewReader(c).ReadString('\n')
+		msg, err := reader.ReadString('\n')
 		if err != nil {
 			return fmt.Errorf("Unable to read from server: %v", err)
 		}
 		elapsed := time.Since(start)
 		msg = strings.TrimSuffix(msg, "\n")
 		if msg != serverMsg {
+			clientUnexpectedMessages.Inc()
 			return fmt.Errorf("Received unexpected server message: %s", msg)
 		}
-		graph.Plot(elapsed)
+		onPong(elapsed)
 	}
-	return nil
 }
 
 func durationToSample(d time.Duration) float64 {
@@ -105,15 +292,18 @@ type ResponseTimeGraph struct {
 	buffer, height, width, offset int
 	precision                     uint
 	max                           time.Duration
+	upperLimit, buttonLimit       time.Duration
 }
 
-func NewResponseTimeGraph() ResponseTimeGraph {
-	return ResponseTimeGraph{
-		buffer:    130,
-		height:    23,
-		offset:    5,
-		precision: 3,
-		data:      [][]float64{{}, {}, {}},
+func NewResponseTimeGraph(buffer, height int, upperLimit, buttonLimit time.Duration) *ResponseTimeGraph {
+	return &ResponseTimeGraph{
+		buffer:      buffer,
+		height:      height,
+		offset:      5,
+		precision:   3,
+		upperLimit:  upperLimit,
+		buttonLimit: buttonLimit,
+		data:        [][]float64{{}, {}, {}},
 	}
 }
 
@@ -130,12 +320,12 @@ func (g *ResponseTimeGraph) Plot(elapsed time.Duration) {
 	sample := durationToSample(elapsed)
 	max := durationToSample(g.max)
 	sampleToPlot := sample
-	if elapsed > upperLimit {
-		sampleToPlot = durationToSample(upperLimit + time.Millisecond)
+	if elapsed > g.upperLimit {
+		sampleToPlot = durationToSample(g.upperLimit + time.Millisecond)
 	}
 	g.data[curRow] = append(g.data[curRow], sampleToPlot)
-	g.data[upperLimitRow] = append(g.data[upperLimitRow], durationToSample(upperLimit))
-	g.data[buttonLimitRow] = append(g.data[buttonLimitRow], durationToSample(buttonLimit))
+	g.data[upperLimitRow] = append(g.data[upperLimitRow], durationToSample(g.upperLimit))
+	g.data[buttonLimitRow] = append(g.data[buttonLimitRow], durationToSample(g.buttonLimit))
 	graph := asciigraph.PlotMany(g.data,
 		asciigraph.Height(g.height),
 		asciigraph.Offset(g.offset),
@@ -153,19 +343,55 @@ func (g *ResponseTimeGraph) Plot(elapsed time.Duration) {
 }
 
 func main() {
-	kind := os.Args[1]
-	addr := os.Args[2]
+	httpAddr := flag.String("http-address", "", "address to serve prometheus metrics at /metrics and client stats at /stats (server only), disabled if empty")
+	interval := flag.Duration("interval", time.Second/8, "time between pings (client only)")
+	output := flag.String("output", "graph", "client output format: graph, json or csv")
+	upperLimit := flag.Duration("upper-limit", 30*time.Millisecond, "response time upper limit, samples above it are clipped at the graph")
+	buttonLimit := flag.Duration("lower-limit", 0, "response time lower limit drawn at the graph")
+	width := flag.Int("width", 130, "number of samples shown at the graph")
+	height := flag.Int("height", 23, "graph height")
+	timeout := flag.Duration("timeout", time.Second, "time to wait for the server pong before reconnecting (client only)")
+	id := flag.String("id", "", "client ID sent to the server to keep its stats across reconnections, the hostname if empty (client only)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] s|c address\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	kind := flag.Arg(0)
+	addr := flag.Arg(1)
 
 	// Resolve TCP Address
 	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
 		panic("Unable to resolve IP")
 	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if *httpAddr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*httpAddr, mux))
+		}()
+	}
+
 	if kind == "s" {
-		err = server(tcpAddr)
+		err = server(tcpAddr, mux)
 
 	} else if kind == "c" {
-		err = client(tcpAddr)
+		if *id == "" {
+			*id, err = os.Hostname()
+		}
+		var plotter Plotter
+		if err == nil {
+			plotter, err = newPlotter(*output, *width, *height, *upperLimit, *buttonLimit)
+		}
+		if err == nil {
+			err = client(tcpAddr, *id, *interval, *timeout, plotter)
+		}
 	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
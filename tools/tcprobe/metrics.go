@@ -0,0 +1,74 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "tcprobe"
+
+var (
+	clientRTT = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "client",
+		Name:      "rtt_seconds",
+		Help:      "Round trip time of ping/pong messages",
+		// from 0.5ms to ~4s
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+	clientDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "client",
+		Name:      "disconnects_total",
+		Help:      "Number of times the connection to the server has been lost",
+	})
+	clientReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "client",
+		Name:      "reconnects_total",
+		Help:      "Number of times the connection to the server has been re-established",
+	})
+	clientUnexpectedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "client",
+		Name:      "unexpected_messages_total",
+		Help:      "Number of unexpected messages received from the server",
+	})
+	clientLastOutage = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "client",
+		Name:      "last_outage_seconds",
+		Help:      "Time between the last pong before a disconnection and the first pong after reconnecting",
+	})
+
+	serverConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "server",
+		Name:      "connections_total",
+		Help:      "Number of connections accepted per client",
+	}, []string{"client"})
+	serverActiveConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "server",
+		Name:      "active_connections",
+		Help:      "Number of open connections per client",
+	}, []string{"client"})
+	serverDisconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "server",
+		Name:      "disconnects_total",
+		Help:      "Number of connections closed per client",
+	}, []string{"client"})
+	serverPings = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "server",
+		Name:      "pings_total",
+		Help:      "Number of pings received per client",
+	}, []string{"client"})
+	serverUnexpectedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "server",
+		Name:      "unexpected_messages_total",
+		Help:      "Number of unexpected messages received per client",
+	}, []string{"client"})
+)
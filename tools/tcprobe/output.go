@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Plotter outputs the response time of every ping sent by the client
+type Plotter interface {
+	Plot(elapsed time.Duration)
+}
+
+func newPlotter(output string, width, height int, upperLimit, buttonLimit time.Duration) (Plotter, error) {
+	switch output {
+	case "graph":
+		return NewResponseTimeGraph(width, height, upperLimit, buttonLimit), nil
+	case "json":
+		return &JSONPlotter{encoder: json.NewEncoder(os.Stdout), upperLimit: upperLimit}, nil
+	case "csv":
+		return &CSVPlotter{writer: csv.NewWriter(os.Stdout), upperLimit: upperLimit}, nil
+	}
+	return nil, fmt.Errorf("Unknown output format: %s", output)
+}
+
+type sampleRecord struct {
+	Time         time.Time `json:"time"`
+	ResponseTime float64   `json:"responseTimeMs"`
+	Max          float64   `json:"maxMs"`
+	AboveLimit   bool      `json:"aboveLimit"`
+}
+
+// JSONPlotter writes one json record per sample, so it can be consumed by
+// log collectors
+type JSONPlotter struct {
+	encoder    *json.Encoder
+	upperLimit time.Duration
+	max        time.Duration
+}
+
+func (p *JSONPlotter) Plot(elapsed time.Duration) {
+	if elapsed > p.max {
+		p.max = elapsed
+	}
+	if err := p.encoder.Encode(sampleRecord{
+		Time:         time.Now(),
+		ResponseTime: durationToSample(elapsed),
+		Max:          durationToSample(p.max),
+		AboveLimit:   elapsed > p.upperLimit,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write json sample: %v\n", err)
+	}
+}
+
+// CSVPlotter writes one csv row per sample after a header row
+type CSVPlotter struct {
+	writer        *csv.Writer
+	upperLimit    time.Duration
+	max           time.Duration
+	headerWritten bool
+}
+
+func (p *CSVPlotter) Plot(elapsed time.Duration) {
+	if elapsed > p.max {
+		p.max = elapsed
+	}
+	if !p.headerWritten {
+		p.writer.Write([]string{"time", "response_time_ms", "max_ms", "above_limit"})
+		p.headerWritten = true
+	}
+	p.writer.Write([]string{
+		time.Now().Format(time.RFC3339Nano),
+		strconv.FormatFloat(durationToSample(elapsed), 'f', 3, 64),
+		strconv.FormatFloat(durationToSample(p.max), 'f', 3, 64),
+		strconv.FormatBool(elapsed > p.upperLimit),
+	})
+	p.writer.Flush()
+	if err := p.writer.Error(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write csv sample: %v\n", err)
+	}
+}